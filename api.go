@@ -2,17 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
-	"math"
 	"md2MarpAPI/styles"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -29,6 +34,7 @@ import (
 type Slide struct {
 	Title   string
 	Content string
+	Images  []string // 別ページに分離する背景画像のURL
 }
 
 // ノード内のテキストを再帰的に抽出する関数
@@ -66,9 +72,39 @@ func extractTextFromQiitaBlock(blockText string) string {
 	return result.String()
 }
 
+// インライン要素がブロック（段落や見出し、リストの項目）の最後にあるか
+// 強調などの中にある場合は、外側の要素もブロックの最後にあるかを調べる
+func endsBlock(n ast.Node) bool {
+	for n.NextSibling() == nil {
+		n = n.Parent()
+		if n == nil || n.Type() == ast.TypeBlock {
+			return true
+		}
+	}
+	return false
+}
+
+// 画像が段落の中で単独で置かれているか
+// 単独の画像だけを背景画像として扱い、文中の画像はその場に残す
+func isBlockImage(n ast.Node, content []byte) bool {
+	parent := n.Parent()
+	if parent == nil {
+		return false
+	}
+	for child := parent.FirstChild(); child != nil; child = child.NextSibling() {
+		if child == n {
+			continue
+		}
+		// 空白だけのテキストは無視
+		if child.Kind() == ast.KindText && strings.TrimSpace(string(child.Text(content))) == "" {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
 // マークダウンをページ（ヘッダー基準）ごとに分ける
-var images []string    // 画像のURL分離用
-var images_index []int // 分離した画像があった配列番号
 func parseMarkdown(content []byte) ([]*Slide, error) {
 
 	// Goldmarkの初期化
@@ -84,11 +120,8 @@ func parseMarkdown(content []byte) ([]*Slide, error) {
 	var currentSlide *Slide
 
 	// ASTを歩いてスライドを構築
-	var count = 0
-	var afterOption = false
 	err := ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
 		if entering {
-			fmt.Println(n.Kind())
 			switch n.Kind() {
 			case ast.KindHeading:
 				heading := n.(*ast.Heading)
@@ -101,31 +134,38 @@ func parseMarkdown(content []byte) ([]*Slide, error) {
 						Title:   headingText,
 						Content: "",
 					}
-					count++
+				} else if currentSlide != nil {
+					// h5,h6 は本文として扱う
+					currentSlide.Content += headingText + "\n"
 				}
-				afterOption = true
-			case ast.KindTextBlock, ast.KindText:
+				// 見出しのテキストは上で処理済みなので子ノードは辿らない
+				return ast.WalkSkipChildren, nil
+			case ast.KindText:
 				// すべてのテキストベースのノードを検査
-				var textContent string
-				if afterOption {
-					afterOption = false
-				} else {
-					textContent = extractText(n, content)
-					if isQiitaBlock(textContent) {
-						// Qiita独自のマークダウンブロックからテキストを抽出
-						text := extractTextFromQiitaBlock(textContent)
-						if currentSlide != nil {
-							currentSlide.Content += text + "\n"
-						}
-						return ast.WalkSkipChildren, nil
-					} else if currentSlide != nil {
-						currentSlide.Content += textContent + "\n"
+				textContent := extractText(n, content)
+				if isQiitaBlock(textContent) {
+					// Qiita独自のマークダウンブロックからテキストを抽出
+					text := extractTextFromQiitaBlock(textContent)
+					if currentSlide != nil {
+						currentSlide.Content += text + "\n"
+					}
+					return ast.WalkSkipChildren, nil
+				} else if currentSlide != nil {
+					// 改行は元の行末とブロックの終わりだけにし、文中の装飾やリンクとは同じ行につなげる
+					textNode := n.(*ast.Text)
+					if textNode.SoftLineBreak() || textNode.HardLineBreak() || endsBlock(n) {
+						textContent += "\n"
 					}
+					currentSlide.Content += textContent
 				}
 			case ast.KindRawHTML:
 				if currentSlide != nil {
+					// インライン HTML は文中のその位置に置き、段落の最後なら改行する
 					rawHtml := n.(*ast.RawHTML)
-					currentSlide.Content += "\n" + string(rawHtml.Text(content))
+					currentSlide.Content += string(rawHtml.Text(content))
+					if endsBlock(n) {
+						currentSlide.Content += "\n"
+					}
 				}
 			case ast.KindHTMLBlock:
 				if currentSlide != nil {
@@ -134,9 +174,8 @@ func parseMarkdown(content []byte) ([]*Slide, error) {
 				}
 			case ast.KindListItem:
 				if currentSlide != nil {
-					// listItem := n.(*ast.ListItem)
-					// currentSlide.Content += "- " + extractText(listItem, content) + "\n"
-					afterOption = true
+					// 項目のテキストは子の Text ノードで追加されるので、ここでは記号だけ付ける
+					currentSlide.Content += "- "
 				}
 			case ast.KindCodeBlock:
 				if currentSlide != nil {
@@ -146,8 +185,12 @@ func parseMarkdown(content []byte) ([]*Slide, error) {
 			case ast.KindCodeSpan:
 				if currentSlide != nil {
 					codeBlock := n.(*ast.CodeSpan)
-					currentSlide.Content += "`" + string(codeBlock.Text(content)) + "`\n"
+					currentSlide.Content += "`" + string(codeBlock.Text(content)) + "`"
+					if endsBlock(n) {
+						currentSlide.Content += "\n"
+					}
 				}
+				return ast.WalkSkipChildren, nil
 			case ast.KindFencedCodeBlock:
 				if currentSlide != nil {
 					codeBlock := n.(*ast.FencedCodeBlock)
@@ -157,25 +200,42 @@ func parseMarkdown(content []byte) ([]*Slide, error) {
 				if currentSlide != nil {
 					image := n.(*ast.Image)
 					imageSrc := string(image.Destination) // 画像のURL
-					images = append(images, fmt.Sprintf("\n---\n![bg fit](%s)\n", imageSrc))
-					images_index = append(images_index, count)
-					afterOption = true
+					if isBlockImage(n, content) {
+						// 単独の画像は背景画像として別ページに分離
+						currentSlide.Images = append(currentSlide.Images, imageSrc)
+					} else {
+						// 文中の画像はその場にインラインで残す
+						imageAlt := extractText(n, content)
+						currentSlide.Content += fmt.Sprintf("![%s](%s)", imageAlt, imageSrc)
+						if endsBlock(n) {
+							currentSlide.Content += "\n"
+						}
+					}
 				}
+				// 代替テキストは上で処理済み
+				return ast.WalkSkipChildren, nil
 			case ast.KindLink:
 				if currentSlide != nil {
 					link := n.(*ast.Link)
 					linkDest := string(link.Destination) // リンク先
 					linkText := extractText(n, content)  // リンクテキスト
-					currentSlide.Content += fmt.Sprintf("\n[%s](%s)\n", linkText, linkDest)
-					afterOption = true
+					currentSlide.Content += fmt.Sprintf("[%s](%s)", linkText, linkDest)
+					if endsBlock(n) {
+						currentSlide.Content += "\n"
+					}
 				}
+				// リンクテキストは上で処理済み
+				return ast.WalkSkipChildren, nil
 			case ast.KindAutoLink:
 				if currentSlide != nil {
 					link := n.(*ast.AutoLink)
 					linkDest := string(link.URL(content)) // リンク先
-					currentSlide.Content += fmt.Sprintf("\n[リンク](%s)\n", linkDest)
-					afterOption = true
+					currentSlide.Content += fmt.Sprintf("[リンク](%s)", linkDest)
+					if endsBlock(n) {
+						currentSlide.Content += "\n"
+					}
 				}
+				return ast.WalkSkipChildren, nil
 			}
 		}
 		return ast.WalkContinue, nil
@@ -192,83 +252,158 @@ func parseMarkdown(content []byte) ([]*Slide, error) {
 }
 
 // Gemini でページごとの内容をスライドっぽくする
-func analyzeContentWithGemini(slides []*Slide) ([]*Slide, error) {
+func analyzeContentWithGemini(slides []*Slide, modelName string) ([]*Slide, error) {
 	ctx := context.Background()
 
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("[ERROR] Error loading .env file")
-	}
-
+	// .env は main で1回だけ読み込んでいる
 	// Gemini APIクライアントを作成する
 	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("[ERROR] failed to create Gemini client: %w", err)
 	}
 	defer client.Close()
 
-	// Gemini のモデル指定
-	model := client.GenerativeModel("gemini-1.5-flash")
-
 	// スライドを15個ずつに分割する
 	fmt.Println("[slide length]:", len(slides))
-	var s_size = 13            // 分割ごとのスライド数　15がmaxだが安定性のために余裕を持たせている
-	var slide_parts [][]*Slide // 分割したスライドの二次元配列
-	if len(slides) > s_size {
-		block := math.Ceil(float64(len(slides)) / float64(s_size))
-		for i := 0; i < int(block); i++ {
-			start := i * s_size
-			end := start + s_size
-			if end > len(slides) {
-				end = len(slides)
-			}
-			slide_parts = append(slide_parts, slides[start:end])
-		}
-	} else {
-		slide_parts = append(slide_parts, slides[0:])
-	}
+	var s_size = 13 // 分割ごとのスライド数　15がmaxだが安定性のために余裕を持たせている
+	batches := splitBatches(len(slides), s_size)
 
-	for j, slide_part := range slide_parts {
+	for j, batch := range batches {
 		var wg sync.WaitGroup
 
 		fmt.Println() // ログを見やすくするために改行
-		for i, slide := range slide_part {
+		for i := batch.start; i < batch.end; i++ {
+			slide := slides[i]
 
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
 				// プロンプト設定するとこ
-				prompt := fmt.Sprintf("コンテンツを箇条書きプレゼン調に要約。コンテンツがない場合は空白を2個出力。それ以外は要約のみ出力 \n\n以下コンテンツ\n\n%s", slide.Content)
+				prompt := buildPrompt(summaryInstruction, slide.Content)
 				// Gemini API を使用してコンテンツを最適化
 				fmt.Println("[send] index:", i)
-				resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+				resp, err := generateContent(ctx, client, modelName, prompt)
 				if err != nil {
 					fmt.Println("[ERROR] at index:", i, "\n", err)
 					return
 				}
 				// レスポンスをスライドに代入
-				for _, part := range resp.Candidates[0].Content.Parts {
-					slide.Content = fmt.Sprintln(part)
+				text, ok := responseText(resp)
+				if !ok {
+					fmt.Println("[WARN] empty response at index:", i)
+					return
 				}
+				slide.Content = text + "\n"
 			}()
 		}
 		wg.Wait()
-		if len(slides) > s_size && j != len(slide_parts)-1 {
-			time.Sleep(62 * time.Second) // 送信時に若干時間がズレるため少し余裕を持たせる
-		}
-		// 分離しておいた画像を代入
-		var image_counter = 0
-		for i, slide := range slides {
-			if slices.Contains(images_index, i+1) {
-				slide.Content += fmt.Sprintln(images[image_counter])
-				image_counter++
-			}
+		if j != len(batches)-1 {
+			time.Sleep(batchDelay)
 		}
 	}
 
 	return slides, nil
 }
 
+// 指定したモデルにプロンプトを送る関数（テストでは Gemini を呼ばないものに差し替える）
+var generateContent = func(ctx context.Context, client *genai.Client, modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+	return client.GenerativeModel(modelName).GenerateContent(ctx, genai.Text(prompt))
+}
+
+// バッチ間の待ち時間（送信時に若干時間がズレるため1分より少し余裕を持たせる）
+var batchDelay = 62 * time.Second
+
+// スライドの配列の中の1バッチ分の範囲（start 以上 end 未満の添字）
+// 部分スライスを持ち回らず、元の配列を添字で参照する
+type batchRange struct {
+	start, end int
+}
+
+// n 個のスライドを size 個ずつのバッチに分ける関数
+func splitBatches(n int, size int) []batchRange {
+	var batches []batchRange
+	for start := 0; start < n; start += size {
+		batches = append(batches, batchRange{start: start, end: min(start+size, n)})
+	}
+	return batches
+}
+
+// 既定で使う Gemini のモデル
+const defaultModel = "gemini-1.5-flash"
+
+// リクエストごとに指定できるモデル
+// 高価なモデルを勝手に使われないよう、MD2S_ALLOWED_MODELS（カンマ区切り）で設定したものだけ許可する
+// 先頭のモデルを既定のモデルとして使う
+var allowedModels = []string{defaultModel, "gemini-1.5-flash-8b"}
+
+// リクエストで指定されたモデルを確認する関数（空なら許可したモデルの先頭）
+func resolveModel(model string) (string, error) {
+	if model == "" {
+		return allowedModels[0], nil
+	}
+	if !slices.Contains(allowedModels, model) {
+		return "", fmt.Errorf("model is not allowed: %s", model)
+	}
+	return model, nil
+}
+
+// 要約の指示（プロンプトのコンテンツより前の部分）
+const summaryInstruction = "コンテンツを箇条書きプレゼン調に要約。コンテンツがない場合は空白を2個出力。それ以外は要約のみ出力"
+
+// 指示とコンテンツから Gemini に送るプロンプトを組み立てる関数
+func buildPrompt(instruction string, content string) string {
+	return fmt.Sprintf("%s \n\n以下コンテンツ\n\n%s", instruction, content)
+}
+
+// SummarizeText のオプション
+type Options struct {
+	Prompt string // 要約の指示（空なら summaryInstruction）
+	Model  string // 使うモデル（空なら許可したモデルの先頭）
+}
+
+// 任意のテキストを1回だけ Gemini で要約する関数
+// パースを通さずにプロンプトを試すためのもの
+func SummarizeText(ctx context.Context, text string, opts Options) (string, error) {
+	instruction := opts.Prompt
+	if instruction == "" {
+		instruction = summaryInstruction
+	}
+	// 空なら許可したモデルの先頭を使う（MD2S_ALLOWED_MODELS の設定に従う）
+	modelName, err := resolveModel(opts.Model)
+	if err != nil {
+		return "", fmt.Errorf("[ERROR] %w", err)
+	}
+
+	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
+	if err != nil {
+		return "", fmt.Errorf("[ERROR] failed to create Gemini client: %w", err)
+	}
+	defer client.Close()
+
+	resp, err := generateContent(ctx, client, modelName, buildPrompt(instruction, text))
+	if err != nil {
+		return "", fmt.Errorf("[ERROR] failed to generate summary: %w", err)
+	}
+	summary, ok := responseText(resp)
+	if !ok {
+		return "", fmt.Errorf("[ERROR] empty response from Gemini")
+	}
+	return summary, nil
+}
+
+// レスポンスの最初の候補のテキストをつなげて取り出す関数
+// 候補や Content が空（安全フィルタでブロックされた場合など）のときは false を返す
+func responseText(resp *genai.GenerateContentResponse) (string, bool) {
+	if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil || len(resp.Candidates[0].Content.Parts) == 0 {
+		return "", false
+	}
+	var text strings.Builder
+	for _, part := range resp.Candidates[0].Content.Parts {
+		text.WriteString(fmt.Sprint(part))
+	}
+	return text.String(), true
+}
+
 // marpタグを冒頭に追加、ページの分かれたスライドを連結
 func convertToMarp(title string, slides []*Slide, style int) string {
 	var marpBuilder strings.Builder
@@ -282,6 +417,10 @@ func convertToMarp(title string, slides []*Slide, style int) string {
 		marpBuilder.WriteString("\n---\n")
 		marpBuilder.WriteString(fmt.Sprintf("# %s\n\n", slide.Title))
 		marpBuilder.WriteString(fmt.Sprintf("%s\n", slide.Content))
+		// 分離しておいた画像をスライドの後ろに1枚ずつ追加
+		for _, image := range slide.Images {
+			marpBuilder.WriteString(fmt.Sprintf("\n---\n![bg fit](%s)\n", image))
+		}
 	}
 
 	return marpBuilder.String()
@@ -302,50 +441,353 @@ func deleteEscape(content []byte) (result []byte) {
 	return result
 }
 
-func md2s(title string, content []byte, style int) (marpContent string) {
+// マークダウンを Marp のスライドに変換する関数
+// リクエストの処理中にサーバーを止めないよう、失敗はエラーとして返す
+func md2s(title string, content []byte, style int, model string) (string, error) {
 	// マークダウンをページごとに変換
 	slides, err := parseMarkdown(content)
 	if err != nil {
-		log.Fatalf("[ERROR] Failed to parse Markdown: %v", err)
+		return "", fmt.Errorf("[ERROR] failed to parse Markdown: %w", err)
 	}
 
 	// Gemini で内容をスライドっぽくする
-	analyzedSlides, err := analyzeContentWithGemini(slides)
+	analyzedSlides, err := analyzeContentWithGemini(slides, model)
 	if err != nil {
-		log.Fatalf("[ERROR] Failed to analyze content: %v", err)
+		return "", fmt.Errorf("[ERROR] failed to analyze content: %w", err)
 	}
 
 	// 連結＆marpタグ追加
-	marpContent = convertToMarp(title, analyzedSlides, style)
+	return convertToMarp(title, analyzedSlides, style), nil
+}
 
-	return marpContent
+// Gemini クライアントが作れる状態か確認する関数
+// クライアントを作るだけで API は呼ばないのでクォータは消費しない
+func checkGeminiReady(ctx context.Context) error {
+	apiKey := os.Getenv("GEMINI_API_KEY")
+	if apiKey == "" {
+		return fmt.Errorf("GEMINI_API_KEY is not set")
+	}
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return err
+	}
+	return client.Close()
 }
 
-func main() {
+// Authorization ヘッダーの API キーを確認するミドルウェア
+// キーが設定されていない場合は認証なしで通す
+func authMiddleware(apiKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if apiKey == "" {
+			c.Next()
+			return
+		}
+		// "Bearer " の付いていないヘッダーは鍵が合っていても拒否する
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// リクエストボディの上限（バイト、MD2S_MAX_BODY_BYTES で変更できる）
+// 巨大なマークダウンでメモリを使い切らないようにする
+var maxBodyBytes int64 = 5 << 20
+
+// リクエストボディを上限までしか読めないようにするミドルウェア
+// Content-Length で上限を超えると分かる場合は読まずに 413 を返す
+func bodyLimitMiddleware(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// JSON の読み込みに失敗したときのレスポンスを返す関数
+// 上限を超えたボディは 413、それ以外は 400 にする
+func abortBind(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+		return
+	}
+	c.JSON(400, gin.H{"error": "Invalid request"})
+}
+
+// Idempotency-Key ごとの変換結果
+type idempotencyEntry struct {
+	inputHash [32]byte
+	done      chan struct{} // 変換が終わったら close される
+	result    string
+	ok        bool // 変換が最後まで終わったか（false のまま done が close されたら失敗）
+	expires   time.Time
+}
+
+// 変換結果を保持しておく時間
+const idempotencyTTL = 10 * time.Minute
+
+var idempotencyMu sync.Mutex
+var idempotencyCache = map[string]*idempotencyEntry{}
+
+// 同じキーで別の内容のリクエストが送られたときのエラー
+var errIdempotencyKeyReused = errors.New("Idempotency-Key is already used with a different request")
+
+// 同じキーと入力の変換を1回だけ実行する関数
+// 処理中なら終わるまで待ち、終わっていれば保持している結果を返す
+// 変換に失敗した場合は結果を保持せず、同じキーで送り直せるようにする
+func runIdempotent(key string, input string, convert func() (string, error)) (string, error) {
+	if key == "" {
+		return convert()
+	}
+	inputHash := sha256.Sum256([]byte(input))
+
+	idempotencyMu.Lock()
+	now := time.Now()
+	for k, e := range idempotencyCache {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(idempotencyCache, k)
+		}
+	}
+	entry, ok := idempotencyCache[key]
+	if ok {
+		idempotencyMu.Unlock()
+		if entry.inputHash != inputHash {
+			return "", errIdempotencyKeyReused
+		}
+		<-entry.done
+		if !entry.ok {
+			// 前の変換が途中で失敗したので、このリクエストで変換し直す
+			return runIdempotent(key, input, convert)
+		}
+		return entry.result, nil
+	}
+	entry = &idempotencyEntry{inputHash: inputHash, done: make(chan struct{})}
+	idempotencyCache[key] = entry
+	idempotencyMu.Unlock()
+
+	// 変換が panic した場合もエントリを消して待っているリクエストを起こし、同じキーで送り直せるようにする
+	defer func() {
+		if entry.ok {
+			return
+		}
+		idempotencyMu.Lock()
+		if idempotencyCache[key] == entry {
+			delete(idempotencyCache, key)
+		}
+		idempotencyMu.Unlock()
+		close(entry.done)
+	}()
+
+	result, err := convert()
+	if err != nil {
+		return "", err
+	}
+
+	idempotencyMu.Lock()
+	entry.result = result
+	entry.ok = true
+	entry.expires = time.Now().Add(idempotencyTTL)
+	idempotencyMu.Unlock()
+	close(entry.done)
+	return result, nil
+}
+
+// 変換結果から ETag を作る関数（内容が同じなら同じ値になる）
+func etagOf(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return fmt.Sprintf("\"%x\"", sum[:16])
+}
+
+// If-None-Match ヘッダーが ETag と一致するか確認する関数
+// カンマ区切りの複数指定、弱い ETag（W/ 付き）、* に対応する
+func matchesETag(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ETag を付けて返し、クライアントが同じ内容を持っていれば 304 を返す関数
+// 304 を返した場合は true
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" && matchesETag(ifNoneMatch, etag) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// シャットダウン時に処理中のリクエストを待つ最大時間
+// Gemini のレート制限待ち(62秒)を含む変換が終わるよう余裕を持たせている
+const shutdownGracePeriod = 90 * time.Second
+
+// エンドポイントを登録したルーターを作る関数
+func newRouter() *gin.Engine {
 	r := gin.Default()
 
+	// 死活監視用のエンドポイント（認証より先に登録して認証対象から外す）
+	r.GET("/healthz", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	r.GET("/readyz", func(c *gin.Context) {
+		if err := checkGeminiReady(c.Request.Context()); err != nil {
+			c.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		c.String(http.StatusOK, "ok")
+	})
+
+	r.Use(authMiddleware(os.Getenv("MD2S_API_KEY"))) // 設定時のみ認証を有効化
+	r.Use(bodyLimitMiddleware(maxBodyBytes))
+
 	// 生データを受け取るエンドポイント
 	r.POST("/md2s", func(c *gin.Context) {
 		var requestBody struct {
 			Title string `json:"title"`
 			Input string `json:"md"` // リクエストボディのJSONフィールド
 			Style int    `json:"style"`
+			Model string `json:"model"` // 省略時は既定のモデル
 		}
 
 		// JSONのバインド
 		if err := c.ShouldBindJSON(&requestBody); err != nil {
-			c.JSON(400, gin.H{"error": "Invalid request"})
+			abortBind(c, err)
+			return
+		}
+
+		model, err := resolveModel(requestBody.Model)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
 
 		decoded := deleteEscape([]byte(requestBody.Input))
 
-		// 文字列変換の例（全て大文字に変換）
-		transformed := md2s(requestBody.Title, decoded, requestBody.Style)
+		// 同じ Idempotency-Key の再送なら変換をやり直さず前回の結果を返す
+		key := c.GetHeader("Idempotency-Key")
+		input := fmt.Sprintf("%s\x00%d\x00%s\x00%s", requestBody.Title, requestBody.Style, model, requestBody.Input)
+		transformed, err := runIdempotent(key, input, func() (string, error) {
+			return md2s(requestBody.Title, decoded, requestBody.Style, model)
+		})
+		if errors.Is(err, errIdempotencyKeyReused) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 
+		// 前回と同じ結果なら本文を返さない
+		if notModified(c, etagOf(transformed)) {
+			return
+		}
 		// 変換後の文字列をそのまま返す
 		c.String(http.StatusOK, transformed)
 	})
 
-	r.Run(":8080") // デフォルトでポート8080で実行
+	// 1つのテキストだけを要約するエンドポイント（プロンプトの調整用）
+	r.POST("/summarize", func(c *gin.Context) {
+		var requestBody struct {
+			Text   string `json:"text"`
+			Prompt string `json:"prompt"` // 省略時は通常の要約の指示
+			Model  string `json:"model"`  // 省略時は既定のモデル
+		}
+
+		if err := c.ShouldBindJSON(&requestBody); err != nil {
+			abortBind(c, err)
+			return
+		}
+		if requestBody.Text == "" {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		model, err := resolveModel(requestBody.Model)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		summary, err := SummarizeText(c.Request.Context(), requestBody.Text, Options{Prompt: requestBody.Prompt, Model: model})
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		etag := etagOf(summary)
+		if notModified(c, etag) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"summary": summary, "etag": etag})
+	})
+
+	return r
+}
+
+// リクエストを受け付け、quit にシグナルが届いたら処理中のリクエストを待ってから止める関数
+// 止め始めた後の新しい接続は受け付けない
+func serve(srv *http.Server, ln net.Listener, quit <-chan os.Signal) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(ln)
+	}()
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("[ERROR] listen: %w", err)
+	case <-quit:
+	}
+	fmt.Println("[INFO] shutting down server...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("[ERROR] server forced to shutdown: %w", err)
+	}
+	fmt.Println("[INFO] server exited")
+	return nil
+}
+
+func main() {
+	godotenv.Load() // .env がない場合は環境変数をそのまま使う
+	if models := os.Getenv("MD2S_ALLOWED_MODELS"); models != "" {
+		allowedModels = nil
+		for _, model := range strings.Split(models, ",") {
+			if model = strings.TrimSpace(model); model != "" {
+				allowedModels = append(allowedModels, model)
+			}
+		}
+		if len(allowedModels) == 0 {
+			log.Fatalf("[ERROR] MD2S_ALLOWED_MODELS has no models: %q", models)
+		}
+	}
+
+	if limit := os.Getenv("MD2S_MAX_BODY_BYTES"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n <= 0 {
+			log.Fatalf("[ERROR] invalid MD2S_MAX_BODY_BYTES: %s", limit)
+		}
+		maxBodyBytes = n
+	}
+
+	ln, err := net.Listen("tcp", ":8080") // デフォルトでポート8080で実行
+	if err != nil {
+		log.Fatalf("[ERROR] listen: %v", err)
+	}
+	srv := &http.Server{Handler: newRouter()}
+
+	// SIGINT/SIGTERM を受け取ったら処理中の変換を待ってから終了する
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	if err := serve(srv, ln, quit); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// テキストだけの Gemini の応答を作る
+func textResponse(text string) *genai.GenerateContentResponse {
+	return &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{Content: &genai.Content{Parts: []genai.Part{genai.Text(text)}}}},
+	}
+}
+
+// Gemini を呼ぶ代わりに reply を使うようにする
+func stubGenerate(t *testing.T, reply func(modelName string, prompt string) (*genai.GenerateContentResponse, error)) {
+	t.Helper()
+	t.Setenv("GEMINI_API_KEY", "test-key")
+	old := generateContent
+	generateContent = func(ctx context.Context, client *genai.Client, modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		return reply(modelName, prompt)
+	}
+	t.Cleanup(func() { generateContent = old })
+}
+
+// カレントディレクトリを一時ディレクトリに移す
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// /md2s の md フィールドの形（クォートして base64）にする
+func encodeMarkdown(md string) string {
+	return base64.StdEncoding.EncodeToString([]byte(strconv.Quote(md)))
+}
+
+func md2sBody(title string, md string) string {
+	return `{"title":` + strconv.Quote(title) + `,"md":"` + encodeMarkdown(md) + `"}`
+}
+
+func TestGracefulShutdownFinishesInFlightConversion(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	stubGenerate(t, func(modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		once.Do(func() { close(started) })
+		<-release
+		return textResponse("- summarized"), nil
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ln.Addr().String()
+	quit := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(&http.Server{Handler: newRouter()}, ln, quit)
+	}()
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		resp, err := http.Post(url+"/md2s", "application/json", strings.NewReader(md2sBody("Deck", "# A\n\nbody\n")))
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		inFlight <- result{status: resp.StatusCode, body: string(body), err: err}
+	}()
+	<-started
+
+	quit <- syscall.SIGTERM
+	// 止め始めた後の新しいリクエストは受け付けない
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(url + "/healthz")
+		if err != nil {
+			break
+		}
+		resp.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("new requests were still accepted after shutdown started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	got := <-inFlight
+	if got.err != nil {
+		t.Fatalf("in-flight request failed: %v", got.err)
+	}
+	if got.status != http.StatusOK || !strings.Contains(got.body, "- summarized") {
+		t.Errorf("in-flight conversion did not complete: %d %q", got.status, got.body)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+}
+
+func TestConversionDoesNotRequireDotenv(t *testing.T) {
+	stubGenerate(t, func(modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		return textResponse("- summarized"), nil
+	})
+	// .env のないディレクトリでも変換のたびに終了しない
+	chdirTemp(t)
+	if marp, err := md2s("Deck", []byte("# A\n\nbody\n"), 0, defaultModel); err != nil || !strings.Contains(marp, "- summarized") {
+		t.Errorf("conversion failed without .env: %v\n%s", err, marp)
+	}
+}
+
+// ルーターにリクエストを送ってレスポンスを返す
+func request(t *testing.T, router http.Handler, method string, path string, body string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthIsEnforcedOnlyWhenConfigured(t *testing.T) {
+	stubGenerate(t, func(modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		return textResponse("- summarized"), nil
+	})
+	body := `{"text":"some text"}`
+
+	t.Setenv("MD2S_API_KEY", "secret")
+	router := newRouter()
+	if rec := request(t, router, "POST", "/summarize", body, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without a key: got %d, want 401", rec.Code)
+	}
+	if rec := request(t, router, "POST", "/summarize", body, map[string]string{"Authorization": "Bearer wrong"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("with a wrong key: got %d, want 401", rec.Code)
+	}
+	if rec := request(t, router, "POST", "/summarize", body, map[string]string{"Authorization": "secret"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without the Bearer prefix: got %d, want 401", rec.Code)
+	}
+	if rec := request(t, router, "POST", "/summarize", body, map[string]string{"Authorization": "Bearer secret"}); rec.Code != http.StatusOK {
+		t.Errorf("with the key: got %d, want 200", rec.Code)
+	}
+
+	t.Setenv("MD2S_API_KEY", "")
+	if rec := request(t, newRouter(), "POST", "/summarize", body, nil); rec.Code != http.StatusOK {
+		t.Errorf("auth disabled: got %d, want 200", rec.Code)
+	}
+}
+
+func TestReadyzNeedsAPIKey(t *testing.T) {
+	t.Setenv("MD2S_API_KEY", "secret")
+	t.Setenv("GEMINI_API_KEY", "")
+	router := newRouter()
+	// 死活監視は認証なしで答える
+	if rec := request(t, router, "GET", "/healthz", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("/healthz: got %d, want 200", rec.Code)
+	}
+	if rec := request(t, router, "GET", "/readyz", "", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz without GEMINI_API_KEY: got %d, want 503", rec.Code)
+	}
+	t.Setenv("GEMINI_API_KEY", "test-key")
+	if rec := request(t, router, "GET", "/readyz", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("/readyz with GEMINI_API_KEY: got %d, want 200", rec.Code)
+	}
+}
+
+func TestIdempotencyKeyRunsConversionOnce(t *testing.T) {
+	var mu sync.Mutex
+	conversions := 0
+	stubGenerate(t, func(modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		conversions++
+		return textResponse(fmt.Sprintf("- summary %d", conversions)), nil
+	})
+	router := newRouter()
+	body := md2sBody("Deck", "# A\n\nbody\n")
+	header := map[string]string{"Idempotency-Key": "same-key-twice"}
+	first := request(t, router, "POST", "/md2s", body, header)
+	second := request(t, router, "POST", "/md2s", body, header)
+	if first.Code != http.StatusOK || second.Code != http.StatusOK {
+		t.Fatalf("got %d and %d, want 200", first.Code, second.Code)
+	}
+	if conversions != 1 {
+		t.Errorf("conversion ran %d times, want 1", conversions)
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("retry got a different result:\n%s\n%s", first.Body, second.Body)
+	}
+	if rec := request(t, router, "POST", "/md2s", md2sBody("Other", "# B\n"), header); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reusing the key for another request: got %d, want 422", rec.Code)
+	}
+}
+
+func TestIdempotencyKeyRecoversFromPanic(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		runIdempotent("panicking-key", "input", func() (string, error) {
+			close(started)
+			<-release
+			panic("conversion failed")
+		})
+	}()
+	<-started
+
+	// 変換中に届いた同じキーのリクエストは、失敗した後に変換し直す
+	waiter := make(chan string, 1)
+	go func() {
+		result, _ := runIdempotent("panicking-key", "input", func() (string, error) { return "converted", nil })
+		waiter <- result
+	}()
+	close(release)
+	select {
+	case result := <-waiter:
+		if result != "converted" {
+			t.Errorf("got %q, want the retried conversion", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request with the same key blocked after the conversion panicked")
+	}
+	if result, err := runIdempotent("panicking-key", "input", func() (string, error) { return "again", nil }); err != nil || result != "converted" {
+		t.Errorf("got %q, %v; want the stored result", result, err)
+	}
+}
+
+func TestNilContentDoesNotPanic(t *testing.T) {
+	stubGenerate(t, func(modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		return &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{FinishReason: genai.FinishReasonSafety}}}, nil
+	})
+	if _, err := SummarizeText(context.Background(), "some text", Options{}); err == nil || !strings.Contains(err.Error(), "empty response") {
+		t.Errorf("got %v, want an empty response error", err)
+	}
+	slides := []*Slide{{Content: "original\n"}}
+	if _, err := analyzeContentWithGemini(slides, defaultModel); err != nil {
+		t.Fatal(err)
+	}
+	if slides[0].Content != "original\n" {
+		t.Errorf("slide was overwritten by an empty response: %q", slides[0].Content)
+	}
+}
+
+func TestSummarizeUsesPromptOverride(t *testing.T) {
+	var prompts []string
+	stubGenerate(t, func(modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		prompts = append(prompts, prompt)
+		return textResponse("- short"), nil
+	})
+	t.Setenv("MD2S_API_KEY", "")
+	router := newRouter()
+	rec := request(t, router, "POST", "/summarize", `{"text":"long text","prompt":"一文で要約"}`, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"summary":"- short"`) {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if len(prompts) != 1 || !strings.HasPrefix(prompts[0], "一文で要約") || !strings.Contains(prompts[0], "long text") {
+		t.Errorf("prompt override was not used: %q", prompts)
+	}
+	if rec := request(t, router, "POST", "/summarize", `{"text":""}`, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("empty text: got %d, want 400", rec.Code)
+	}
+}
+
+func TestBatchesDoNotMixSlideContent(t *testing.T) {
+	batchDelay = 0
+	t.Cleanup(func() { batchDelay = 62 * time.Second })
+	numbered := regexp.MustCompile(`body(\d+)`)
+	stubGenerate(t, func(modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		return textResponse("- summary" + numbered.FindStringSubmatch(prompt)[1]), nil
+	})
+	var md strings.Builder
+	for i := 1; i <= 30; i++ {
+		fmt.Fprintf(&md, "# S%d\n\nbody%d\n\n", i, i)
+	}
+	if batches := splitBatches(30, 13); len(batches) != 3 || batches[2] != (batchRange{start: 26, end: 30}) {
+		t.Fatalf("unexpected batches: %v", batches)
+	}
+	slides, err := parseMarkdown([]byte(md.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slides, err = analyzeContentWithGemini(slides, defaultModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, slide := range slides {
+		if want := fmt.Sprintf("- summary%d\n", i+1); slide.Content != want {
+			t.Errorf("slide %d: got %q, want %q", i+1, slide.Content, want)
+		}
+	}
+}
+
+func TestModelOverrideIsAllowListed(t *testing.T) {
+	var models []string
+	stubGenerate(t, func(modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		models = append(models, modelName)
+		return textResponse("- summarized"), nil
+	})
+	t.Setenv("MD2S_API_KEY", "")
+	router := newRouter()
+	if rec := request(t, router, "POST", "/summarize", `{"text":"some text","model":"gemini-1.5-flash-8b"}`, nil); rec.Code != http.StatusOK {
+		t.Fatalf("allowed model: got %d %s", rec.Code, rec.Body)
+	}
+	if rec := request(t, router, "POST", "/summarize", `{"text":"some text","model":"gemini-1.5-pro"}`, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("disallowed model: got %d, want 400", rec.Code)
+	}
+	if len(models) != 1 || models[0] != "gemini-1.5-flash-8b" {
+		t.Errorf("Gemini was called with %q, want only the override", models)
+	}
+
+	// 既定のモデルは許可したモデルの先頭
+	old := allowedModels
+	allowedModels = []string{"gemini-1.5-pro"}
+	t.Cleanup(func() { allowedModels = old })
+	if model, err := resolveModel(""); err != nil || model != "gemini-1.5-pro" {
+		t.Errorf("resolveModel(\"\") = %q, %v; want the first allowed model", model, err)
+	}
+	models = nil
+	if _, err := SummarizeText(context.Background(), "some text", Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(models) != 1 || models[0] != "gemini-1.5-pro" {
+		t.Errorf("SummarizeText used %q, want the first allowed model", models)
+	}
+}
+
+func TestInlineLinkStaysOnItsLine(t *testing.T) {
+	slides, err := parseMarkdown([]byte("# A\n\nsee [the docs](https://x.dev) and `code` for more\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "see [the docs](https://x.dev) and `code` for more\n"; slides[0].Content != want {
+		t.Errorf("got %q, want %q", slides[0].Content, want)
+	}
+}
+
+func TestETagSupportsConditionalRequests(t *testing.T) {
+	stubGenerate(t, func(modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		return textResponse("- summarized"), nil
+	})
+	t.Setenv("MD2S_API_KEY", "")
+	router := newRouter()
+	body := md2sBody("Deck", "# A\n\nbody\n")
+	first := request(t, router, "POST", "/md2s", body, nil)
+	second := request(t, router, "POST", "/md2s", body, nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got %d with ETag %q", first.Code, etag)
+	}
+	if second.Header().Get("ETag") != etag {
+		t.Errorf("identical input gave ETags %q and %q", etag, second.Header().Get("ETag"))
+	}
+	summary := request(t, router, "POST", "/summarize", `{"text":"some text"}`, nil)
+	if tag := summary.Header().Get("ETag"); tag == "" || !strings.Contains(summary.Body.String(), `"etag":`+strconv.Quote(tag)) {
+		t.Errorf("ETag %q is not in the JSON body: %s", tag, summary.Body)
+	}
+	rec := request(t, router, "POST", "/md2s", body, map[string]string{"If-None-Match": "W/" + etag})
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("conditional request: got %d %q, want an empty 304", rec.Code, rec.Body)
+	}
+	if rec := request(t, router, "POST", "/md2s", body, map[string]string{"If-None-Match": `"other"`}); rec.Code != http.StatusOK {
+		t.Errorf("non-matching ETag: got %d, want 200", rec.Code)
+	}
+}
+
+func TestOversizedBodyIsRejected(t *testing.T) {
+	old := maxBodyBytes
+	maxBodyBytes = 64
+	t.Cleanup(func() { maxBodyBytes = old })
+	t.Setenv("MD2S_API_KEY", "")
+	router := newRouter()
+	body := `{"text":"` + strings.Repeat("x", 100) + `"}`
+	if rec := request(t, router, "POST", "/summarize", body, nil); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("with Content-Length: got %d, want 413", rec.Code)
+	}
+	// Content-Length のない（chunked の）リクエストも読み込み中に止める
+	req := httptest.NewRequest("POST", "/md2s", io.MultiReader(strings.NewReader(body)))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("without Content-Length: got %d, want 413", rec.Code)
+	}
+}
+
+func TestInlineHTMLStaysOnItsLine(t *testing.T) {
+	slides, err := parseMarkdown([]byte("# A\n\npress <kbd>Enter</kbd> now\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "press <kbd>Enter</kbd> now\n"; slides[0].Content != want {
+		t.Errorf("got %q, want %q", slides[0].Content, want)
+	}
+}
+
+func TestImagesDoNotLeakIntoLaterRequests(t *testing.T) {
+	stubGenerate(t, func(modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		return textResponse("- summarized"), nil
+	})
+	router := newRouter()
+	first := request(t, router, "POST", "/md2s", md2sBody("Deck", "# A\n\ntext\n\n![](first.png)\n"), nil)
+	if first.Code != http.StatusOK || strings.Count(first.Body.String(), "(first.png)") != 1 {
+		t.Fatalf("first request: got %d\n%s", first.Code, first.Body.String())
+	}
+	second := request(t, router, "POST", "/md2s", md2sBody("Deck", "# B\n\nother\n"), nil)
+	if second.Code != http.StatusOK {
+		t.Fatalf("second request: got %d\n%s", second.Code, second.Body.String())
+	}
+	if strings.Contains(second.Body.String(), "first.png") {
+		t.Errorf("image from the first request leaked into the second:\n%s", second.Body.String())
+	}
+}
+
+func TestConversionErrorAnswers500(t *testing.T) {
+	// クライアントが作れない場合もプロセスを終了せずに 500 を返す
+	t.Setenv("GEMINI_API_KEY", "")
+	router := newRouter()
+	if rec := request(t, router, "POST", "/md2s", md2sBody("Deck", "# A\n\nbody\n"), nil); rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want 500\n%s", rec.Code, rec.Body.String())
+	}
+
+	// 失敗した変換は保持せず、同じキーで送り直せる
+	header := map[string]string{"Idempotency-Key": "failing-key"}
+	request(t, router, "POST", "/md2s", md2sBody("Deck", "# A\n\nbody\n"), header)
+	stubGenerate(t, func(modelName string, prompt string) (*genai.GenerateContentResponse, error) {
+		return textResponse("- summarized"), nil
+	})
+	if rec := request(t, router, "POST", "/md2s", md2sBody("Deck", "# A\n\nbody\n"), header); rec.Code != http.StatusOK {
+		t.Errorf("retry with the same key: got %d, want 200\n%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestInlineImageStaysInText(t *testing.T) {
+	slides, err := parseMarkdown([]byte("# A\n\ntext ![icon](i.png) more\n\n![](bg.png)\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "text ![icon](i.png) more\n"; slides[0].Content != want {
+		t.Errorf("got %q, want %q", slides[0].Content, want)
+	}
+	if len(slides[0].Images) != 1 || slides[0].Images[0] != "bg.png" {
+		t.Errorf("only the standalone image should become a background, got %q", slides[0].Images)
+	}
+}
@@ -1,37 +1,188 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
+	"io"
 	"log"
-	"math"
+	"maps"
 	"md2MarpAPI/styles"
+	"mime"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/generative-ai-go/genai"
 	"github.com/joho/godotenv"
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
 	"github.com/yuin/goldmark/text"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 // スライド1ページの型指定
 type Slide struct {
-	Title   string
-	Content string
+	Title     string
+	Content   string
+	Math      []string     // 数式だけの段落のプレースホルダー（要約で消えたときに補う）
+	Notes     []string     // 発表者ノート（元のマークダウンの HTML コメント）
+	Code      []string     // Gemini に渡さず保持するコードブロック
+	Images    []SlideImage // 別ページに分離する背景画像（本文中の位置はプレースホルダー）
+	WideTable bool         // 列の多い表を含むか（文字を小さくする）
+	Class     string       // このスライドだけに付ける Marp のクラス
+	Parent    string       // 一つ上の階層の見出し（同名の見出しの区別に使う）
+	Line      int          // 元のマークダウンでの見出しの行番号（1始まり、0 なら不明）
+	Level     int          // 見出しのレベル（1〜4、見出しのないリードスライドは 0）
+	Order     int          // <!-- order: N --> で指定した並び順（1始まり、0 なら指定なし）
+	Failed    bool         // 要約に失敗し、元の内容のまま出力するか
+}
+
+// コードブロックをスライドに追加する
+// keepCode が有効な場合は本文にプレースホルダーだけ残し、コードは要約対象から外す
+var keepCode = true
+
+func (s *Slide) addCode(code string) {
+	if !keepCode {
+		s.Content += "\n" + code + "\n"
+		return
+	}
+	s.Content += fmt.Sprintf("\n{{CODE%d}}\n", len(s.Code))
+	s.Code = append(s.Code, code)
+}
+
+// 別ページに分離する背景画像
+type SlideImage struct {
+	Src     string // 画像のURL（タイトル属性付き）
+	Mode    string // Marp の背景指定（bg cover など、空なら backgroundMode）
+	Caption string // 画像の下に出すキャプション（空なら出さない）
+}
+
+// 背景画像の既定の表示方法（bg, bg fit, bg cover, bg contain, bg left, bg right など）
+var backgroundMode = "bg fit"
+
+// 背景画像のページの本文（Marp の画像記法とキャプション）を返す
+// キャプションは背景の上に重ねてページの下端に寄せる
+func (img SlideImage) directive() string {
+	mode := img.Mode
+	if mode == "" {
+		mode = backgroundMode
+	}
+	page := fmt.Sprintf("![%s](%s)", mode, img.Src)
+	if img.Caption != "" {
+		page += "\n\n<style scoped>section{justify-content:flex-end;text-align:center}</style>\n\n" + img.Caption
+	}
+	return page
+}
+
+// 画像の代替テキスト、または直後の斜体だけの段落をキャプションにするか
+var imageCaptions = false
+
+// 画像の直後にある斜体だけの段落（*キャプション*）ならその文字列を返す関数
+func followingCaption(paragraph ast.Node, content []byte) (ast.Node, string, bool) {
+	next := paragraph.NextSibling()
+	if next == nil || next.Kind() != ast.KindParagraph || next.ChildCount() != 1 {
+		return nil, "", false
+	}
+	emphasis, ok := next.FirstChild().(*ast.Emphasis)
+	if !ok || emphasis.Level != 1 {
+		return nil, "", false
+	}
+	return next, strings.TrimSpace(extractText(emphasis, content)), true
+}
+
+// 出力したときのページ数（分離した画像と、その後に続く本文のページを含む）
+func (s *Slide) pageCount() int {
+	texts, images := s.splitAtImages(s.body())
+	pages := 1 + len(images)
+	for _, text := range texts[1:] {
+		if strings.TrimSpace(text) != "" {
+			pages++
+		}
+	}
+	return pages
+}
+
+// 本文も数式・コード・画像・ノートもないスライドか
+func (s *Slide) isEmpty() bool {
+	return strings.TrimSpace(s.Content) == "" && len(s.Math) == 0 && len(s.Code) == 0 && len(s.Images) == 0 && len(s.Notes) == 0
+}
+
+// 背景画像をスライドに追加する
+// 本文中の位置をプレースホルダーで残し、出力時にその位置でページを分ける
+func (s *Slide) addImage(image SlideImage) {
+	s.Content += fmt.Sprintf("\n{{IMAGE%d}}\n", len(s.Images))
+	s.Images = append(s.Images, image)
+}
+
+// 本文を画像の位置で分割する
+// texts[i] の後に images[i] のページが入る（texts は images より1つ多い）
+// 要約でプレースホルダーが消えた画像は末尾に回す
+func (s *Slide) splitAtImages(body string) (texts []string, images []SlideImage) {
+	var missing []SlideImage
+	for i, image := range s.Images {
+		placeholder := fmt.Sprintf("{{IMAGE%d}}", i)
+		before, after, found := strings.Cut(body, placeholder)
+		if !found {
+			missing = append(missing, image)
+			continue
+		}
+		texts = append(texts, before)
+		images = append(images, image)
+		body = after
+	}
+	texts = append(texts, body)
+	for _, image := range missing {
+		images = append(images, image)
+		texts = append(texts, "")
+	}
+	return texts, images
+}
+
+// プレースホルダーを元のコードブロックに戻す
+// 要約でプレースホルダーが消えた場合は末尾に付け足す
+func (s *Slide) restoreCode(content string) string {
+	for i, code := range s.Code {
+		placeholder := fmt.Sprintf("{{CODE%d}}", i)
+		if strings.Contains(content, placeholder) {
+			content = strings.Replace(content, placeholder, code, 1)
+		} else {
+			content += "\n" + code + "\n"
+		}
+	}
+	return content
 }
 
 // ノード内のテキストを再帰的に抽出する関数
 func extractText(n ast.Node, content []byte) string {
 	var result string
 	ast.Walk(n, func(child ast.Node, entering bool) (ast.WalkStatus, error) {
-		if entering {
+		if script, ok := child.(*scriptNode); ok {
+			// 下付き・上付き文字は記号ごと戻す
+			result += string(script.marker)
+		} else if child.Kind() == extast.KindStrikethrough {
+			// 取り消し線も記号ごと戻す
+			result += "~~"
+		} else if entering {
 			if child.Kind() == ast.KindText || child.Kind() == ast.KindString {
 				result += string(child.Text(content))
 			}
@@ -41,137 +192,686 @@ func extractText(n ast.Node, content []byte) string {
 	return result
 }
 
-// Qiita独自マークダウンを判定する関数
-func isQiitaBlock(content string) bool {
-	// Qiita独自のマークダウン構文をチェック
+// ::: で囲むコンテナ記法の方言（qiita, zenn, none）
+var containerDialect = "qiita"
+
+// コンテナの ::: の行（::: の後ろの部分）を出力する行に変換する関数
+// false を返した行は出力しない
+type containerRenderer func(marker string) (string, bool)
+
+var containerDialects = map[string]containerRenderer{
+	// Qiita の :::note info などは枠の指定だけなので行ごと消す
+	"qiita": func(marker string) (string, bool) {
+		return "", false
+	},
+	// Zenn の :::message と :::details は見出し付きの引用にする
+	// 中身の行は引用の続きとして扱われ、閉じの ::: で引用が終わる
+	"zenn": func(marker string) (string, bool) {
+		kind, label, _ := strings.Cut(strings.TrimSpace(marker), " ")
+		label = strings.TrimSpace(label)
+		switch {
+		case kind == "message" && label == "alert":
+			return "> **⚠ 注意**", true
+		case kind == "message":
+			return "> **ℹ メッセージ**", true
+		case kind == "details" && label != "":
+			return fmt.Sprintf("> **%s**", label), true
+		}
+		return "", false
+	},
+}
+
+// コンテナ記法を判定する関数
+func isContainerBlock(content string) bool {
+	if _, ok := containerDialects[containerDialect]; !ok {
+		return false
+	}
 	return strings.Contains(strings.TrimSpace(content), ":::")
 }
 
-// Qiita独自ブロックからテキストを抽出する関数
-func extractTextFromQiitaBlock(blockText string) string {
-	var result strings.Builder
+// コンテナ記法のブロックを方言に合わせて変換する関数
+func renderContainerBlock(blockText string) string {
+	render := containerDialects[containerDialect]
+	var result []string
 	lines := strings.Split(blockText, "\n")
 	for _, line := range lines {
+		trimmed := trimTrailingSpace(strings.TrimLeft(line, " \t"))
+		// コンテナのタグ行（:::で始まる行）は方言ごとに変換
+		if marker, ok := strings.CutPrefix(trimmed, ":::"); ok {
+			if rendered, ok := render(marker); ok {
+				result = append(result, rendered)
+			}
+			continue
+		}
+		result = append(result, trimmed)
+	}
+	return strings.Join(result, "\n")
+}
+
+// 行末の2つ以上の空白による改行（ハードブレーク）を残すか
+// 残さない場合は行末の空白をすべて消し、意図しない改行が Marp で起きないようにする
+var keepHardBreaks = false
+
+// 各行の行末の空白を消す関数
+// keepHardBreaks のときは、空白が2つ以上あった行だけ空白2つにそろえて残す
+func trimTrailingSpace(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, " \t")
+		if keepHardBreaks && trimmed != "" && strings.HasSuffix(line, "  ") {
+			trimmed += "  "
+		}
+		lines[i] = trimmed
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 数式（$...$, $$...$$）の検出用
+// $$...$$ は複数行にまたがってもよいが、空行や見出しの行はまたがない
+var mathPattern = regexp.MustCompile(`\$\$[^$\n]*(?:\n[ \t]*[^\s#$][^$\n]*)*(?:\n[ \t]*)?\$\$|\$[^\s$](?:[^$\n]*?[^\s$])?\$`)
+var mathPlaceholderPattern = regexp.MustCompile(`^\{\{MATH\d+\}\}$`)
+var mathList []string // 数式の退避用
+
+// 数式をプレースホルダーに置き換えて退避する関数
+// KaTeX の記法がパーサーや Gemini に崩されないようにする
+// コードの範囲（codeRanges の結果）の中の $ は数式として扱わない
+func extractMath(content []byte, code [][2]int) []byte {
+	mathList = nil
+	replace := func(part []byte) []byte {
+		return mathPattern.ReplaceAllFunc(part, func(m []byte) []byte {
+			placeholder := fmt.Sprintf("{{MATH%d}}", len(mathList))
+			mathList = append(mathList, string(m))
+			return []byte(placeholder)
+		})
+	}
+	var result []byte
+	last := 0
+	for _, r := range code {
+		if r[0] < last {
+			continue
+		}
+		result = append(result, replace(content[last:r[0]])...)
+		result = append(result, content[r[0]:r[1]]...)
+		last = r[1]
+	}
+	return append(result, replace(content[last:])...)
+}
+
+// コードブロックとインラインのコードの範囲（文書内の位置）を前から順に返す関数
+// シェルの $$ のようなコード中の $ を数式と取り違えないようにする
+func codeRanges(doc ast.Node) [][2]int {
+	var ranges [][2]int
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n.Kind() {
+		case ast.KindFencedCodeBlock, ast.KindCodeBlock:
+			if lines := n.Lines(); lines.Len() > 0 {
+				ranges = append(ranges, [2]int{lines.At(0).Start, lines.At(lines.Len() - 1).Stop})
+			}
+			return ast.WalkSkipChildren, nil
+		case ast.KindCodeSpan:
+			first, ok := n.FirstChild().(*ast.Text)
+			last, ok2 := n.LastChild().(*ast.Text)
+			if ok && ok2 {
+				ranges = append(ranges, [2]int{first.Segment.Start, last.Segment.Stop})
+			}
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return ranges
+}
+
+// 数式を退避した後の本文の位置から元の行番号（1始まり）を求める関数
+// 複数行の数式はプレースホルダーで1行になっているので、その分の改行を足す
+func sourceLine(content []byte, pos int) int {
+	before := content[:pos]
+	line := 1 + bytes.Count(before, []byte("\n"))
+	for _, m := range mathPlaceholderInlinePattern.FindAllSubmatch(before, -1) {
+		if i, err := strconv.Atoi(string(m[1])); err == nil && i < len(mathList) {
+			line += strings.Count(mathList[i], "\n")
+		}
+	}
+	return line
+}
+
+var mathPlaceholderInlinePattern = regexp.MustCompile(`\{\{MATH(\d+)\}\}`)
+
+// プレースホルダーを元の数式に戻す関数
+func restoreMath(s string) string {
+	for i, m := range mathList {
+		s = strings.ReplaceAll(s, fmt.Sprintf("{{MATH%d}}", i), m)
+	}
+	return s
+}
+
+// 代替テキストで背景画像の表示方法を指定する書き方（![bg cover](...) など）
+var backgroundHintPattern = regexp.MustCompile(`^bg(\s|$)`)
+
+// 画像パスの中で Marp の画像記法を壊す文字をエンコードする関数
+var imageDestReplacer = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29", "<", "%3C", ">", "%3E")
+
+func escapeImageDest(dest string) string {
+	return imageDestReplacer.Replace(dest)
+}
+
+// 画像がブロック内の唯一の要素か（背景画像にするか）を判定する関数
+func isBlockImage(n ast.Node, content []byte) bool {
+	parent := n.Parent()
+	if parent == nil {
+		return false
+	}
+	for child := parent.FirstChild(); child != nil; child = child.NextSibling() {
+		if child == n {
+			continue
+		}
+		// 空白だけのテキストは無視
+		if child.Kind() == ast.KindText && strings.TrimSpace(string(child.Text(content))) == "" {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// リンクテキストを取り出す関数
+// [![alt](img)](url) のようにリンクの中にある画像は画像の記法のまま残す
+func extractLinkText(link ast.Node, content []byte) string {
+	var text strings.Builder
+	for child := link.FirstChild(); child != nil; child = child.NextSibling() {
+		if image, ok := child.(*ast.Image); ok {
+			imageSrc := escapeImageDest(string(image.Destination))
+			if len(image.Title) > 0 {
+				imageSrc += fmt.Sprintf(" %q", string(image.Title))
+			}
+			text.WriteString(fmt.Sprintf("![%s](%s)", extractText(image, content), imageSrc))
+			continue
+		}
+		text.WriteString(extractText(child, content))
+	}
+	return text.String()
+}
+
+// 見出しから属性の指定と先頭の番号を取り除くか
+var cleanHeadings = false
+
+// 見出し末尾の属性の指定（{#anchor} や {.class}）と先頭の番号（1. や 2.3 など、2024 のような数だけは残す）
+var headingAttributePattern = regexp.MustCompile(`\s*\{[#.][^{}]*\}\s*$`)
+var headingNumberPattern = regexp.MustCompile(`^(\d+(\.\d+)*[.)]|\d+(\.\d+)+)\s+`)
+
+// 見出しをスライドのタイトル向けに整える関数
+func cleanHeading(heading string) string {
+	heading = headingAttributePattern.ReplaceAllString(heading, "")
+	heading = headingNumberPattern.ReplaceAllString(strings.TrimSpace(heading), "")
+	return strings.TrimSpace(heading)
+}
+
+// リストの項目記号（ネストの深さ分のインデント付き）を返す関数
+func listItemMarker(n ast.Node) string {
+	list, ok := n.Parent().(*ast.List)
+	if !ok {
+		return "- "
+	}
+	depth := 0
+	for p := list.Parent(); p != nil; p = p.Parent() {
+		if p.Kind() == ast.KindList {
+			depth++
+		}
+	}
+	indent := strings.Repeat("  ", depth)
+	if !list.IsOrdered() {
+		return indent + "- "
+	}
+	index := list.Start
+	for prev := n.PreviousSibling(); prev != nil; prev = prev.PreviousSibling() {
+		index++
+	}
+	return fmt.Sprintf("%s%d. ", indent, index)
+}
+
+// コードをフェンスで囲む関数
+// コードは末尾の改行1つだけを付けてそのまま入れ、中のバッククォートより長いフェンスを使う
+var backtickRunPattern = regexp.MustCompile("`+")
+
+func fenceCode(code string, info string) string {
+	if !strings.HasSuffix(code, "\n") {
+		code += "\n"
+	}
+	longest := 0
+	for _, run := range backtickRunPattern.FindAllString(code, -1) {
+		longest = max(longest, len(run))
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+	return fence + info + "\n" + code + fence
+}
+
+// 表を GFM の表の記法に組み立て直す関数
+// セルは元のマークダウンのまま使い、区切り行には列の揃え方を残す
+func tableMarkdown(table *extast.Table, content []byte) string {
+	var tableBuilder strings.Builder
+	for row := table.FirstChild(); row != nil; row = row.NextSibling() {
+		tableBuilder.WriteString("|")
+		for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			tableBuilder.WriteString(fmt.Sprintf(" %s |", cell.Lines().Value(content)))
+		}
+		tableBuilder.WriteString("\n")
+		if row.Kind() != extast.KindTableHeader {
+			continue
+		}
+		tableBuilder.WriteString("|")
+		for _, alignment := range table.Alignments {
+			switch alignment {
+			case extast.AlignLeft:
+				tableBuilder.WriteString(":---|")
+			case extast.AlignRight:
+				tableBuilder.WriteString("---:|")
+			case extast.AlignCenter:
+				tableBuilder.WriteString(":---:|")
+			default:
+				tableBuilder.WriteString("---|")
+			}
+		}
+		tableBuilder.WriteString("\n")
+	}
+	return tableBuilder.String()
+}
+
+// 閉じられていないコードフェンスを検出する関数
+// 閉じフェンスがなく、中に見出しらしき行を含む場合は閉じ忘れとみなす
+var headingLinePattern = regexp.MustCompile(`(?m)^#{1,4}\s`)
+
+func isUnterminatedFence(codeBlock *ast.FencedCodeBlock, content []byte) bool {
+	lines := codeBlock.Lines()
+	if lines.Len() == 0 {
+		return false
+	}
+	rest := strings.TrimSpace(string(content[lines.At(lines.Len()-1).Stop:]))
+	if strings.HasPrefix(rest, "```") || strings.HasPrefix(rest, "~~~") {
+		return false
+	}
+	return headingLinePattern.Match(codeBlock.Lines().Value(content))
+}
+
+// HTML コメントならその中身を発表者ノートとして返す関数
+func parseNoteComment(htmlText string) (string, bool) {
+	trimmed := strings.TrimSpace(htmlText)
+	if !strings.HasPrefix(trimmed, "<!--") || !strings.HasSuffix(trimmed, "-->") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(trimmed, "<!--"), "-->")), true
+}
+
+// パーサーで使う goldmark の拡張
+// gfm（GitHub Flavored Markdown）、commonmark（拡張なし）、または個別の拡張をカンマ区切りで指定する
+var markdownExtensions = "gfm"
+var extensionList = map[string]goldmark.Extender{
+	"gfm":           extension.GFM,
+	"table":         extension.Table,
+	"strikethrough": extension.Strikethrough,
+	"linkify":       extension.Linkify,
+	"tasklist":      extension.TaskList,
+	"subscript":     Subscript,
+	"superscript":   Superscript,
+}
+
+func buildExtensions(spec string) ([]goldmark.Extender, error) {
+	var extensions []goldmark.Extender
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "commonmark" {
+			continue
+		}
+		ext, ok := extensionList[name]
+		if !ok {
+			return nil, fmt.Errorf("[ERROR] unknown markdown extension: %s", name)
+		}
+		extensions = append(extensions, ext)
+	}
+	return extensions, nil
+}
+
+// この列数以上の表を含むスライドは表の文字を小さくする（0 なら無効）
+var wideTableColumns = 0
+
+// スライド単位のクラス指定（<!-- _class: lead --> または <!-- class: lead -->）
+var classDirectivePattern = regexp.MustCompile(`^_?class:\s*(.+)$`)
+
+// スライドの並び順の指定（<!-- order: 99 -->）
+var orderDirectivePattern = regexp.MustCompile(`^order:\s*(\d+)$`)
+
+// 元のマークダウンのフロントマターにあるタグ
+var documentTags []string
+
+// 先頭のフロントマター（--- で囲まれた部分）を本文から切り離す関数
+func splitFrontMatter(content []byte) (string, []byte) {
+	text := strings.ReplaceAll(string(content), "\r\n", "\n")
+	if !strings.HasPrefix(text, "---\n") {
+		return "", content
+	}
+	frontMatter, body, found := strings.Cut(text[len("---\n"):], "\n---\n")
+	if !found {
+		return "", content
+	}
+	return frontMatter, []byte(body)
+}
+
+// フロントマターから tags を取り出す関数
+// Qiita（- name: go）、Zenn（topics: [go]）、カンマや空白区切りの書き方に対応
+var tagsKeyPattern = regexp.MustCompile(`^(tags|topics):\s*(.*)$`)
+
+func parseTags(frontMatter string) []string {
+	var tags []string
+	inTags := false
+	for _, line := range strings.Split(frontMatter, "\n") {
+		if m := tagsKeyPattern.FindStringSubmatch(line); m != nil {
+			inTags = true
+			value := strings.Trim(strings.TrimSpace(m[2]), "[]")
+			for _, tag := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+				tags = append(tags, strings.Trim(tag, `"'`))
+			}
+			continue
+		}
 		trimmed := strings.TrimSpace(line)
-		// Qiita独自マークダウンのタグ行（:::で始まる行）は無視
-		if strings.HasPrefix(trimmed, ":::") {
+		if !inTags || !strings.HasPrefix(trimmed, "-") {
+			// リストが終わったら tags の読み取りも終わり
+			if inTags && trimmed != "" && !strings.HasPrefix(line, " ") {
+				inTags = false
+			}
 			continue
 		}
-		result.WriteString(trimmed + "\n")
+		tag := strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+		tag = strings.TrimSpace(strings.TrimPrefix(tag, "name:"))
+		if tag != "" {
+			tags = append(tags, strings.Trim(tag, `"'`))
+		}
+	}
+	return tags
+}
+
+// 直前の parseMarkdown で出した警告（-check で問題として数える）
+var parseWarnings []string
+
+// 変換時の警告を parseWarnings に記録する関数
+// 表示は呼び出し側で行う（-check では問題として1回だけ出すため）
+func warnParse(message string) {
+	parseWarnings = append(parseWarnings, message)
+}
+
+// インライン要素がブロック（段落や見出し、リストの項目）の最後にあるか
+// 強調などの中にある場合は、外側の要素もブロックの最後にあるかを調べる
+func endsBlock(n ast.Node) bool {
+	for n.NextSibling() == nil {
+		n = n.Parent()
+		if n == nil || n.Type() == ast.TypeBlock {
+			return true
+		}
 	}
-	return result.String()
+	return false
 }
 
 // マークダウンをページ（ヘッダー基準）ごとに分ける
-var images []string    // 画像のURL分離用
-var images_index []int // 分離した画像があった配列番号
 func parseMarkdown(content []byte) ([]*Slide, error) {
+	parseWarnings = nil
+	// 空の入力からはフロントマターだけの壊れたスライドになるので変換しない
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil, fmt.Errorf("[ERROR] input markdown is empty")
+	}
 
 	// Goldmarkの初期化
+	extensions, err := buildExtensions(markdownExtensions)
+	if err != nil {
+		return nil, err
+	}
 	mdParser := goldmark.New(
-		goldmark.WithExtensions(
-			extension.GFM, // GitHub Flavored Markdown
-		),
+		goldmark.WithExtensions(extensions...),
 	)
+	frontMatter, content := splitFrontMatter(content)
+	documentTags = parseTags(frontMatter)
+	// 行番号を元のファイルに合わせるため、切り離したフロントマターの行数を足す
+	lineOffset := 0
+	if frontMatter != "" {
+		lineOffset = strings.Count(frontMatter, "\n") + 3
+	}
+	// 数式を退避する前にコードの位置を調べ、コードの中は退避しない
+	content = extractMath(content, codeRanges(mdParser.Parser().Parse(text.NewReader(content))))
 	reader := text.NewReader([]byte(content))
 	doc := mdParser.Parser().Parse(reader)
 
 	var slides []*Slide
-	var currentSlide *Slide
+	// 最初の見出しより前の文章（記事の概要など）はタイトルの次のリードスライドにする
+	leadSlide := &Slide{Class: "lead"}
+	currentSlide := leadSlide
+	var headingStack [5]string    // 見出しレベルごとの直近の見出し（h1〜h4）
+	containerLineEnd := 0         // 処理済みのコンテナのタグ行の終わりの位置
+	var captionParagraph ast.Node // キャプションとして使った段落（本文には入れない）
 
 	// ASTを歩いてスライドを構築
-	var count = 0
-	var afterOption = false
-	err := ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+	err = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
 		if entering {
-			fmt.Println(n.Kind())
 			switch n.Kind() {
 			case ast.KindHeading:
 				heading := n.(*ast.Heading)
 				headingText := extractText(heading, content)
+				if cleanHeadings {
+					headingText = cleanHeading(headingText)
+				}
 				if heading.Level <= 4 { // h1,h2,h3,h4 to title
-					if currentSlide != nil {
+					if currentSlide != leadSlide || !leadSlide.isEmpty() {
 						slides = append(slides, currentSlide)
 					}
 					currentSlide = &Slide{
 						Title:   headingText,
 						Content: "",
+						Level:   heading.Level,
+					}
+					if lines := heading.Lines(); lines.Len() > 0 {
+						currentSlide.Line = lineOffset + sourceLine(content, lines.At(0).Start)
+					}
+					for level := heading.Level - 1; level >= 1; level-- {
+						if headingStack[level] != "" {
+							currentSlide.Parent = headingStack[level]
+							break
+						}
 					}
-					count++
+					headingStack[heading.Level] = headingText
+					clear(headingStack[heading.Level+1:])
+				} else if currentSlide != nil {
+					// h5,h6 は本文として扱う
+					currentSlide.Content += headingText + "\n"
 				}
-				afterOption = true
-			case ast.KindTextBlock, ast.KindText:
+				// 見出しのテキストは上で処理済みなので子ノードは辿らない
+				return ast.WalkSkipChildren, nil
+			case ast.KindText:
 				// すべてのテキストベースのノードを検査
-				var textContent string
-				if afterOption {
-					afterOption = false
-				} else {
-					textContent = extractText(n, content)
-					if isQiitaBlock(textContent) {
-						// Qiita独自のマークダウンブロックからテキストを抽出
-						text := extractTextFromQiitaBlock(textContent)
-						if currentSlide != nil {
-							currentSlide.Content += text + "\n"
+				textContent := extractText(n, content)
+				segment := n.(*ast.Text).Segment
+				if segment.Start < containerLineEnd {
+					// コンテナのタグ行の残り（:::details のタイトルなど）は処理済み
+					return ast.WalkSkipChildren, nil
+				}
+				if isContainerBlock(textContent) {
+					if strings.HasPrefix(textContent, ":::") {
+						// テキストは空白で分かれるので、タグ行は元の行全体で判定する
+						lineEnd := bytes.IndexByte(content[segment.Start:], '\n')
+						if lineEnd < 0 {
+							lineEnd = len(content) - segment.Start
 						}
-						return ast.WalkSkipChildren, nil
-					} else if currentSlide != nil {
-						currentSlide.Content += textContent + "\n"
+						containerLineEnd = segment.Start + lineEnd
+						textContent = string(content[segment.Start:containerLineEnd])
+					}
+					// Qiita・Zenn独自のコンテナ記法からテキストを抽出
+					text := renderContainerBlock(textContent)
+					if currentSlide != nil {
+						currentSlide.Content += text + "\n"
+					}
+					return ast.WalkSkipChildren, nil
+				} else if currentSlide != nil && n.Parent().ChildCount() == 1 && mathPlaceholderPattern.MatchString(strings.TrimSpace(textContent)) {
+					// 数式だけの段落は本文の位置にプレースホルダーのまま残し、要約で消えたときのために控えておく
+					placeholder := strings.TrimSpace(textContent)
+					currentSlide.Content += "\n" + placeholder + "\n"
+					currentSlide.Math = append(currentSlide.Math, placeholder)
+				} else if currentSlide != nil {
+					// パーサーは行末の空白を外すので、ハードブレークは付け直す
+					textNode := n.(*ast.Text)
+					if keepHardBreaks && textNode.HardLineBreak() {
+						textContent += "  "
 					}
+					// 改行は元の行末とブロックの終わりだけにし、文中の装飾やリンクとは同じ行につなげる
+					if textNode.SoftLineBreak() || textNode.HardLineBreak() || endsBlock(n) {
+						textContent += "\n"
+					}
+					currentSlide.Content += textContent
 				}
 			case ast.KindRawHTML:
 				if currentSlide != nil {
 					rawHtml := n.(*ast.RawHTML)
-					currentSlide.Content += "\n" + string(rawHtml.Text(content))
+					// インライン HTML は文中のその位置に置き、段落の最後なら改行する
+					html := string(rawHtml.Text(content))
+					if pdfMode {
+						// PDF では HTML を描画しないので、タグを外した文字だけ残す
+						html = htmlToText(html)
+					}
+					if endsBlock(n) {
+						html += "\n"
+					}
+					currentSlide.Content += html
 				}
 			case ast.KindHTMLBlock:
 				if currentSlide != nil {
 					html := n.(*ast.HTMLBlock)
-					currentSlide.Content += "\n" + string(html.Text(content)) + "\n"
+					htmlText := string(html.Text(content))
+					if note, ok := parseNoteComment(htmlText); ok {
+						if m := classDirectivePattern.FindStringSubmatch(note); m != nil {
+							// <!-- _class: ... --> はそのスライドだけのクラス指定
+							currentSlide.Class = m[1]
+						} else if m := orderDirectivePattern.FindStringSubmatch(note); m != nil {
+							// <!-- order: N --> は出力時にそのスライドを N 番目に移す
+							currentSlide.Order, _ = strconv.Atoi(m[1])
+						} else {
+							// HTML コメントは発表者ノートとして要約対象から外す
+							currentSlide.Notes = append(currentSlide.Notes, note)
+						}
+					} else if pdfMode {
+						currentSlide.Content += "\n" + htmlToText(htmlText) + "\n"
+					} else {
+						currentSlide.Content += "\n" + htmlText + "\n"
+					}
+				}
+			case KindSubscript, KindSuperscript, extast.KindStrikethrough:
+				if currentSlide != nil {
+					currentSlide.Content += extractText(n, content)
+					if endsBlock(n) {
+						currentSlide.Content += "\n"
+					}
 				}
+				return ast.WalkSkipChildren, nil
+			case extast.KindTable:
+				if currentSlide != nil {
+					table := n.(*extast.Table)
+					if wideTableColumns > 0 && len(table.Alignments) >= wideTableColumns {
+						currentSlide.WideTable = true
+					}
+					// 表は記法のまま出力し、コードと同じく要約で崩れないよう退避する
+					currentSlide.addCode(tableMarkdown(table, content))
+				}
+				// セルのテキストは上で処理済み
+				return ast.WalkSkipChildren, nil
 			case ast.KindListItem:
 				if currentSlide != nil {
-					// listItem := n.(*ast.ListItem)
-					// currentSlide.Content += "- " + extractText(listItem, content) + "\n"
-					afterOption = true
+					// 項目のテキストは子の Text ノードで追加されるので、ここでは記号だけ付ける
+					currentSlide.Content += listItemMarker(n)
 				}
 			case ast.KindCodeBlock:
 				if currentSlide != nil {
 					codeBlock := n.(*ast.CodeBlock)
-					currentSlide.Content += "\n```\n" + string(codeBlock.Text(content)) + "\n```\n"
+					currentSlide.addCode(fenceCode(string(codeBlock.Text(content)), ""))
+				}
+			case ast.KindParagraph:
+				if n == captionParagraph {
+					return ast.WalkSkipChildren, nil
 				}
 			case ast.KindCodeSpan:
 				if currentSlide != nil {
 					codeBlock := n.(*ast.CodeSpan)
-					currentSlide.Content += "`" + string(codeBlock.Text(content)) + "`\n"
+					currentSlide.Content += "`" + string(codeBlock.Text(content)) + "`"
+					if endsBlock(n) {
+						currentSlide.Content += "\n"
+					}
 				}
+				return ast.WalkSkipChildren, nil
 			case ast.KindFencedCodeBlock:
 				if currentSlide != nil {
 					codeBlock := n.(*ast.FencedCodeBlock)
-					currentSlide.Content += "\n```\n" + string(codeBlock.Text(content)) + "\n```\n"
+					if isUnterminatedFence(codeBlock, content) {
+						warnParse("code fence may be unterminated; following sections were merged into one code block: " + currentSlide.Title)
+					}
+					language := ""
+					if codeBlock.Info != nil {
+						language = string(codeBlock.Info.Segment.Value(content))
+					}
+					currentSlide.addCode(fenceCode(string(codeBlock.Text(content)), language))
 				}
 			case ast.KindImage:
 				if currentSlide != nil {
 					image := n.(*ast.Image)
-					imageSrc := string(image.Destination) // 画像のURL
-					images = append(images, fmt.Sprintf("\n---\n![bg fit](%s)\n", imageSrc))
-					images_index = append(images_index, count)
-					afterOption = true
+					imageSrc := escapeImageDest(string(image.Destination)) // 画像のURL
+					if len(image.Title) > 0 {
+						// タイトル属性があれば URL の後ろに残す
+						imageSrc += fmt.Sprintf(" %q", string(image.Title))
+					}
+					if isBlockImage(n, content) {
+						// 単独の画像は背景画像として別ページに分離
+						// 代替テキストが "bg cover" のような指定ならその画像だけ表示方法を変える
+						image := SlideImage{Src: imageSrc}
+						imageAlt := strings.TrimSpace(extractText(n, content))
+						if backgroundHintPattern.MatchString(imageAlt) {
+							image.Mode = imageAlt
+						} else if imageCaptions {
+							image.Caption = imageAlt
+						}
+						if imageCaptions {
+							// 直後の斜体だけの段落は代替テキストより優先してキャプションにする
+							if paragraph, caption, ok := followingCaption(n.Parent(), content); ok {
+								image.Caption = caption
+								captionParagraph = paragraph
+							}
+						}
+						currentSlide.addImage(image)
+					} else {
+						// 文中の画像はその場にインラインで残す
+						imageAlt := extractText(n, content)
+						currentSlide.Content += fmt.Sprintf("![%s](%s)", imageAlt, imageSrc)
+						if endsBlock(n) {
+							currentSlide.Content += "\n"
+						}
+					}
 				}
+				// 代替テキストは上で処理済み
+				return ast.WalkSkipChildren, nil
 			case ast.KindLink:
 				if currentSlide != nil {
 					link := n.(*ast.Link)
-					linkDest := string(link.Destination) // リンク先
-					linkText := extractText(n, content)  // リンクテキスト
-					currentSlide.Content += fmt.Sprintf("\n[%s](%s)\n", linkText, linkDest)
-					afterOption = true
+					linkDest := string(link.Destination)    // リンク先
+					linkText := extractLinkText(n, content) // リンクテキスト
+					currentSlide.Content += fmt.Sprintf("[%s](%s)", linkText, linkDest)
+					if endsBlock(n) {
+						currentSlide.Content += "\n"
+					}
 				}
+				// リンクテキストは上で処理済み
+				return ast.WalkSkipChildren, nil
 			case ast.KindAutoLink:
 				if currentSlide != nil {
 					link := n.(*ast.AutoLink)
 					linkDest := string(link.URL(content)) // リンク先
-					currentSlide.Content += fmt.Sprintf("\n[リンク](%s)\n", linkDest)
-					afterOption = true
+					currentSlide.Content += fmt.Sprintf("[リンク](%s)", linkDest)
+					if endsBlock(n) {
+						currentSlide.Content += "\n"
+					}
 				}
+				return ast.WalkSkipChildren, nil
 			}
 		}
 		return ast.WalkContinue, nil
@@ -181,152 +881,1766 @@ func parseMarkdown(content []byte) ([]*Slide, error) {
 	}
 
 	// 最後のスライドを追加
-	if currentSlide != nil {
+	if currentSlide != leadSlide || !leadSlide.isEmpty() {
 		slides = append(slides, currentSlide)
 	}
+	// フロントマターやディレクティブだけの入力も空のデッキになるので変換しない
+	if len(slides) == 0 {
+		return nil, fmt.Errorf("[ERROR] input markdown has no slides")
+	}
+	if sectionName != "" {
+		return selectSection(slides, sectionName)
+	}
 	return slides, nil
 }
 
-// Gemini でページごとの内容をスライドっぽくする
-func analyzeContentWithGemini(slides []*Slide) ([]*Slide, error) {
-	ctx := context.Background()
+// 変換する見出し（空なら文書全体）
+var sectionName = ""
 
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("[ERROR] Error loading .env file")
+// 指定した見出しとその下の階層のスライドだけを取り出す関数
+// 見出しは大文字小文字を区別せずに比べ、最初に一致したものを使う
+func selectSection(slides []*Slide, name string) ([]*Slide, error) {
+	for i, slide := range slides {
+		if slide.Level == 0 || !strings.EqualFold(strings.TrimSpace(slide.Title), strings.TrimSpace(name)) {
+			continue
+		}
+		end := i + 1
+		for end < len(slides) && slides[end].Level > slide.Level {
+			end++
+		}
+		return slides[i:end], nil
 	}
+	return nil, fmt.Errorf("[ERROR] section not found: %s", name)
+}
 
-	// Gemini APIクライアントを作成する
-	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
-	if err != nil {
-		log.Fatal(err)
+// 使用する Gemini のモデル
+const geminiModel = "gemini-1.5-flash"
+
+// モデルに設定する安全フィルタのしきい値
+// セキュリティ系の技術記事などが誤ってブロックされる場合に緩める
+var safetySettings = safetyFlag{}
+
+// -safety で "category=threshold" を繰り返し指定できるようにする
+type safetyFlag []*genai.SafetySetting
+
+var harmCategories = map[string]genai.HarmCategory{
+	"harassment": genai.HarmCategoryHarassment,
+	"hate":       genai.HarmCategoryHateSpeech,
+	"sexual":     genai.HarmCategorySexuallyExplicit,
+	"dangerous":  genai.HarmCategoryDangerousContent,
+}
+
+var harmThresholds = map[string]genai.HarmBlockThreshold{
+	"low":    genai.HarmBlockLowAndAbove,
+	"medium": genai.HarmBlockMediumAndAbove,
+	"high":   genai.HarmBlockOnlyHigh,
+	"none":   genai.HarmBlockNone,
+}
+
+func (f *safetyFlag) String() string {
+	var settings []string
+	for _, setting := range *f {
+		settings = append(settings, fmt.Sprintf("%s=%s", setting.Category, setting.Threshold))
 	}
-	defer client.Close()
+	return strings.Join(settings, ",")
+}
 
-	// Gemini のモデル指定
-	model := client.GenerativeModel("gemini-1.5-flash")
-
-	// スライドを15個ずつに分割する
-	fmt.Println("[slide length]:", len(slides))
-	var s_size = 13            // 分割ごとのスライド数　15がmaxだが安定性のために余裕を持たせている
-	var slide_parts [][]*Slide // 分割したスライドの二次元配列
-	if len(slides) > s_size {
-		block := math.Ceil(float64(len(slides)) / float64(s_size))
-		for i := 0; i < int(block); i++ {
-			start := i * s_size
-			end := start + s_size
-			if end > len(slides) {
-				end = len(slides)
-			}
-			slide_parts = append(slide_parts, slides[start:end])
-		}
-	} else {
-		slide_parts = append(slide_parts, slides[0:])
+func (f *safetyFlag) Set(value string) error {
+	name, level, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("safety setting must be \"category=threshold\": %s", value)
 	}
+	category, ok := harmCategories[strings.TrimSpace(name)]
+	if !ok {
+		return fmt.Errorf("unknown harm category: %s (harassment, hate, sexual, dangerous)", name)
+	}
+	threshold, ok := harmThresholds[strings.TrimSpace(level)]
+	if !ok {
+		return fmt.Errorf("unknown block threshold: %s (low, medium, high, none)", level)
+	}
+	*f = append(*f, &genai.SafetySetting{Category: category, Threshold: threshold})
+	return nil
+}
 
-	for j, slide_part := range slide_parts {
-		var wg sync.WaitGroup
+// .env の読み込みは1回だけ行う
+var loadEnvOnce sync.Once
+var loadDotenv = godotenv.Load // テストで読み込みの回数を数えるために差し替える
 
-		fmt.Println() // ログを見やすくするために改行
-		for i, slide := range slide_part {
+func loadEnv() {
+	loadEnvOnce.Do(func() {
+		// .env がなくても環境変数に GEMINI_API_KEY があれば動くので警告に留める
+		if err := loadDotenv(); err != nil {
+			fmt.Println("[WARN] .env file not found, using environment variables")
+		}
+	})
+}
 
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				// プロンプト設定するとこ
-				prompt := fmt.Sprintf("コンテンツを箇条書きプレゼン調に要約。コンテンツがない場合は空白を2個出力。それ以外は要約のみ出力 \n\n以下コンテンツ\n\n%s", slide.Content)
-				// Gemini API を使用してコンテンツを最適化
-				fmt.Println("[send] index:", i)
-				resp, err := model.GenerateContent(ctx, genai.Text(prompt))
-				if err != nil {
-					fmt.Println("[ERROR] at index:", i, "\n", err)
-					return
-				}
-				// レスポンスをスライドに代入
-				for _, part := range resp.Candidates[0].Content.Parts {
-					slide.Content = fmt.Sprintln(part)
-				}
-			}()
+// 要約用のプロンプトを組み立てる関数
+var summaryStyle = "bullets" // 要約スタイル（styles.SummaryStyleList のキー）
+var headingContext = false   // 見出しをプロンプトに含めるか
+var maxBullets = 0           // 1スライドの箇条書きの最大数（0 なら制限なし）
+var keepNesting = false      // 箇条書きの入れ子を保って項目ごとに要約するか
+var bulletsPerSlide = 0      // 1スライドの箇条書きの数をちょうどこの数にする（0 なら指定しない）
+func buildSummaryPrompt(slide *Slide) string {
+	// プロンプト設定するとこ
+	var instruction strings.Builder
+	instruction.WriteString(styles.SummaryStyleList[summaryStyle])
+	if headingContext {
+		// 見出しは文脈として渡すだけで出力には含めない
+		instruction.WriteString(fmt.Sprintf("内容は見出し「%s」に沿うようにし、見出し自体は出力しない。", slide.Title))
+	}
+	if keepNesting && isListGroup(slide.Content) {
+		// 項目ごとに要約するときは入れ子の形を崩させない
+		instruction.WriteString("箇条書きの項目数と入れ子（インデント）はそのままにし、各項目を短く言い換える。")
+	} else if bulletsPerSlide > 0 {
+		instruction.WriteString(fmt.Sprintf("箇条書きはちょうど%d個にする。", bulletsPerSlide))
+	} else if maxBullets > 0 {
+		instruction.WriteString(fmt.Sprintf("箇条書きは最大%d個まで。", maxBullets))
+	}
+	instruction.WriteString("コンテンツがない場合は空白を2個出力。{{MATH0}}や{{CODE0}}や{{IMAGE0}}のような記号は数式やコード、画像なので変更せずそのまま残す。&amp;や&lt;のような文字参照も文字に戻さずそのまま残す。それ以外は要約のみ出力")
+	return fmt.Sprintf("%s \n\n以下コンテンツ\n\n%s", instruction.String(), slide.Content)
+}
+
+// 箇条書きの項目を最大数までに切り詰める関数
+// 超えた項目はその下にネストされた行ごと削除する
+var bulletPattern = regexp.MustCompile(`^([-*+•]|\d+[.)])\s`)
+
+func trimBullets(content string, limit int) string {
+	if limit <= 0 {
+		return content
+	}
+	var result []string
+	count := 0
+	skipping := false
+	for _, line := range strings.Split(content, "\n") {
+		indented := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		if !indented && bulletPattern.MatchString(line) {
+			count++
+			skipping = count > limit
+		} else if !indented && strings.TrimSpace(line) != "" {
+			skipping = false
 		}
-		wg.Wait()
-		if len(slides) > s_size && j != len(slide_parts)-1 {
-			time.Sleep(62 * time.Second) // 送信時に若干時間がズレるため少し余裕を持たせる
+		if !skipping {
+			result = append(result, line)
 		}
-		// 分離しておいた画像を代入
-		var image_counter = 0
-		for i, slide := range slides {
-			if slices.Contains(images_index, i+1) {
-				slide.Content += fmt.Sprintln(images[image_counter])
-				image_counter++
+	}
+	return strings.Join(result, "\n")
+}
+
+// 箇条書きの項目をちょうど n 個にそろえる関数
+// 多い分は切り詰め、足りない分は長い項目を文の区切りで2つに分けて補う
+var sentenceEndPattern = regexp.MustCompile(`[。！？]\s*|[.!?]\s+`)
+
+func fitBullets(content string, n int) string {
+	lines := strings.Split(trimBullets(content, n), "\n")
+	for {
+		count := 0
+		longest := -1
+		for i, line := range lines {
+			if !bulletPattern.MatchString(line) {
+				continue
 			}
+			count++
+			if longest < 0 || len(line) > len(lines[longest]) {
+				longest = i
+			}
+		}
+		if count == 0 || count >= n {
+			return strings.Join(lines, "\n")
 		}
+		marker := bulletPattern.FindString(lines[longest])
+		item := strings.TrimPrefix(lines[longest], marker)
+		// 最後以外の文の区切りで分ける（区切りがなければこれ以上補えない）
+		loc := sentenceEndPattern.FindStringIndex(item)
+		if loc == nil || loc[1] >= len(strings.TrimRight(item, " ")) {
+			fmt.Println("[WARN] could not pad bullets to", n, "items")
+			return strings.Join(lines, "\n")
+		}
+		first, second := strings.TrimSpace(item[:loc[1]]), strings.TrimSpace(item[loc[1]:])
+		lines = slices.Insert(lines, longest+1, marker+second)
+		lines[longest] = marker + first
 	}
+}
 
-	return slides, nil
+// 変換を始める前に API キーと接続を確認する関数
+// 生成はせずトークン数を数えるだけなので、生成のクォータは消費しない
+func preflightGemini(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
+	if err != nil {
+		return fmt.Errorf("[ERROR] failed to create Gemini client: %w", err)
+	}
+	defer client.Close()
+	if _, err := countTokens(ctx, client.GenerativeModel(geminiModel), "ping"); err != nil {
+		return fmt.Errorf("[ERROR] Gemini pre-flight check failed (check GEMINI_API_KEY and network): %w", err)
+	}
+	return nil
 }
 
-// marpタグを冒頭に追加、ページの分かれたスライドを連結
-func convertToMarp(slides []*Slide, title []byte, style int) string {
-	var marpBuilder strings.Builder
-	marpBuilder.WriteString("---\nmarp: true") // Marpタグ
-	marpBuilder.WriteString(styles.ThemeList[style])
+// 要約するスライドの範囲（1始まり、0 なら全体）
+var rangeStart, rangeEnd = 0, 0
+
+// "5-10" 形式の範囲指定を解釈する関数
+func parseSlideRange(s string) (start int, end int, err error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("[ERROR] invalid range: %s", s)
+	}
+	start, err = strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, fmt.Errorf("[ERROR] invalid range start: %w", err)
+	}
+	end, err = strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return 0, 0, fmt.Errorf("[ERROR] invalid range end: %w", err)
+	}
+	if start < 1 || end < start {
+		return 0, 0, fmt.Errorf("[ERROR] invalid range: %s", s)
+	}
+	return start, end, nil
+}
+
+// 範囲内のスライドだけを返す関数
+// 範囲外のスライドは要約せずアウトラインのまま出力される
+func selectSlideRange(slides []*Slide) []*Slide {
+	if rangeStart == 0 {
+		return slides
+	}
+	start := min(rangeStart-1, len(slides))
+	end := min(rangeEnd, len(slides))
+	return slides[start:end]
+}
+
+// Marp のページ区切りと解釈される区切り線（---, ***, ___, - - - など）の行をエスケープする関数
+// コードブロック内はそのまま残す
+var separatorPattern = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+
+func escapeSlideSeparators(content string) string {
+	lines := strings.Split(content, "\n")
+	inFence := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if !inFence && separatorPattern.MatchString(line) {
+			lines[i] = "\\" + strings.TrimSpace(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 応答全体を囲むコードフェンスの開始行（```markdown, ```md, ``` のみ）
+var outerFencePattern = regexp.MustCompile("(?i)^(`{3,}|~{3,})\\s*(markdown|md)?\\s*$")
+
+// Gemini が応答全体を ```markdown ... ``` で囲んできた場合に外側のフェンスだけを外す関数
+// 中にフェンスが奇数個残る（外側の閉じが途中にある）場合は囲みではないのでそのまま返す
+func stripOuterFence(content string) string {
+	lines := strings.Split(strings.TrimSpace(content), "\n")
+	if len(lines) < 2 {
+		return content
+	}
+	m := outerFencePattern.FindStringSubmatch(strings.TrimSpace(lines[0]))
+	if m == nil || strings.TrimSpace(lines[len(lines)-1]) != m[1] {
+		return content
+	}
+	inner := lines[1 : len(lines)-1]
+	fences := 0
+	for _, line := range inner {
+		if strings.HasPrefix(strings.TrimSpace(line), m[1][:3]) {
+			fences++
+		}
+	}
+	if fences%2 != 0 {
+		return content
+	}
+	return strings.Join(inner, "\n")
+}
+
+// Gemini の1分あたりのリクエスト数の上限（無料枠の gemini-1.5-flash は15）
+var requestsPerMinute = 15
+
+// Gemini の1分あたりの入力トークン数の上限（無料枠の gemini-1.5-flash は100万）
+var tokensPerMinute = 1000000
+
+// レート制限に合わせた送信ペース
+type pacing struct {
+	batchSize   int           // 1回にまとめて送るリクエスト数
+	batchTokens int           // 1回にまとめて送る推定トークン数
+	delay       time.Duration // バッチ間の待ち時間
+}
+
+// 1分あたりのリクエスト数の上限から送信ペースを決める関数
+// 上限ぎりぎりだと不安定なので1割強の余裕を持たせ（15なら13）、
+// 送信時に若干時間がズレるため待ち時間も1分より少し長くする
+func newPacing(rpm int, tpm int) pacing {
+	return pacing{
+		batchSize:   max(1, rpm*13/15),
+		batchTokens: max(1, tpm*13/15),
+		delay:       batchDelay,
+	}
+}
+
+// バッチ間の待ち時間
+var batchDelay = 62 * time.Second
+
+// レスポンスの最初の候補のテキストをすべてつなげて取り出す関数
+// 候補や Content が空（安全フィルタでブロックされた場合など）のときは false を返す
+func responseText(resp *genai.GenerateContentResponse) (string, bool) {
+	if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil || len(resp.Candidates[0].Content.Parts) == 0 {
+		return "", false
+	}
+	var text strings.Builder
+	for _, part := range resp.Candidates[0].Content.Parts {
+		text.WriteString(fmt.Sprint(part))
+	}
+	text.WriteString("\n")
+	return text.String(), true
+}
+
+// レート制限（429）や一時的な過負荷（503）のときは待ってから送り直す回数と最初の待ち時間
+// 待ち時間はテストで短くするために変数にしている
+const maxRateLimitRetries = 3
+
+var rateLimitBackoff = 15 * time.Second
+
+func isRateLimitError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "429") || strings.Contains(msg, "RESOURCE_EXHAUSTED") || strings.Contains(msg, "ResourceExhausted")
+}
+
+// トークン数を数える関数（テストでは Gemini を呼ばないものに差し替える）
+var countTokens = func(ctx context.Context, model *genai.GenerativeModel, text string) (*genai.CountTokensResponse, error) {
+	return model.CountTokens(ctx, genai.Text(text))
+}
+
+// 送り直せば成功しそうなエラーか
+func isRetryableError(err error) bool {
+	msg := err.Error()
+	return isRateLimitError(err) || strings.Contains(msg, "503") || strings.Contains(msg, "UNAVAILABLE") || strings.Contains(msg, "Unavailable")
+}
+
+// レート制限や一時的なエラーの場合は待ち時間を倍にしながら送り直す関数
+func generateWithBackoff(ctx context.Context, model *genai.GenerativeModel, prompt string) (*genai.GenerateContentResponse, error) {
+	wait := rateLimitBackoff
+	for retry := 0; ; retry++ {
+		if err := takeRequest(); err != nil {
+			return nil, err
+		}
+		resp, err := generateContent(ctx, model, prompt)
+		if err == nil || !isRetryableError(err) || retry >= maxRateLimitRetries {
+			return resp, err
+		}
+		fmt.Println("[WARN] temporary error, retrying in", wait, ":", err)
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+		wait *= 2
+	}
+}
+
+// 待ち時間の途中で ctx が終わった場合は待たずにエラーを返す関数
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 1回の実行で Gemini に送るリクエスト数の上限（タイトル生成・再送を含む、0 なら制限なし）
+var maxRequests = 0
+var requestCount atomic.Int64
+
+var errRequestBudget = errors.New("request budget exceeded")
+
+// リクエストを1回分数え、上限を超える場合は送らずにエラーを返す関数
+func takeRequest() error {
+	if n := requestCount.Add(1); maxRequests > 0 && n > int64(maxRequests) {
+		return fmt.Errorf("%w (max %d)", errRequestBudget, maxRequests)
+	}
+	return nil
+}
+
+// リクエスト数が上限に達したか
+func requestBudgetExhausted() bool {
+	return maxRequests > 0 && requestCount.Load() >= int64(maxRequests)
+}
+
+// ストリーミング API で受け取るか
+var useStream = false
+
+// プロンプトを送って応答のテキストを返す関数
+func generateText(ctx context.Context, model *genai.GenerativeModel, prompt string) (string, error) {
+	if useStream {
+		return generateStreamText(ctx, model, prompt)
+	}
+	resp, err := generateWithBackoff(ctx, model, prompt)
+	if err != nil {
+		return "", err
+	}
+	text, ok := responseText(resp)
+	if !ok {
+		return "", fmt.Errorf("empty response from Gemini")
+	}
+	return text, nil
+}
+
+// ストリーミングの応答を届いた順に返すもの（*genai.GenerateContentResponseIterator）
+type contentIterator interface {
+	Next() (*genai.GenerateContentResponse, error)
+}
+
+// ストリーミングでプロンプトを送る関数（テストでは Gemini を呼ばないものに差し替える）
+var generateContentStream = func(ctx context.Context, model *genai.GenerativeModel, prompt string) contentIterator {
+	return model.GenerateContentStream(ctx, genai.Text(prompt))
+}
+
+// ストリーミング API で応答を受け取り、届いた順につなげる関数
+// 途中でエラーになった場合は部分的な応答を使わずにエラーを返す
+func generateStreamText(ctx context.Context, model *genai.GenerativeModel, prompt string) (string, error) {
+	wait := rateLimitBackoff
+	for retry := 0; ; retry++ {
+		var text strings.Builder
+		if err := takeRequest(); err != nil {
+			return "", err
+		}
+		iter := generateContentStream(ctx, model, prompt)
+		var err error
+		for {
+			var resp *genai.GenerateContentResponse
+			resp, err = iter.Next()
+			if err != nil {
+				break
+			}
+			if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+				continue
+			}
+			for _, part := range resp.Candidates[0].Content.Parts {
+				text.WriteString(fmt.Sprint(part))
+			}
+		}
+		if err == iterator.Done {
+			if text.Len() == 0 {
+				return "", fmt.Errorf("empty response from Gemini")
+			}
+			return text.String() + "\n", nil
+		}
+		// 何も受け取っていないうちの一時的なエラーなら待ってから送り直す
+		if text.Len() > 0 || !isRetryableError(err) || retry >= maxRateLimitRetries {
+			return "", fmt.Errorf("stream interrupted: %w", err)
+		}
+		fmt.Println("[WARN] temporary error, retrying in", wait, ":", err)
+		if err := sleepContext(ctx, wait); err != nil {
+			return "", err
+		}
+		wait *= 2
+	}
+}
+
+// 1リクエストで送るスライド内容の推定トークン数の上限
+var maxSlideTokens = 30000
+
+// トークン数を見積もらずに CountTokens で数えるか
+var exactTokens = false
+
+// トークン数を見積もる関数（バッチの分割や大きすぎるスライドの分割に使う）
+// 通常は API を呼ばない見積もりを使い、-exact-tokens のときは countTokensWith に差し替える
+var estimateTokens = heuristicTokens
+
+// トークン数をおおまかに見積もる関数
+// ASCII は4文字で1トークン、それ以外（日本語など）は1文字1トークンとして数える
+func heuristicTokens(s string) int {
+	ascii, other := 0, 0
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// おおまかな見積もりの代わりに Gemini の CountTokens で正確に数える関数を返す
+// 数えるたびにリクエストを送るので遅く、失敗したときはおおまかな見積もりを使う
+func countTokensWith(ctx context.Context, model *genai.GenerativeModel) func(string) int {
+	return func(s string) int {
+		resp, err := countTokens(ctx, model, s)
+		if err != nil {
+			fmt.Println("[WARN] failed to count tokens, using estimate:", err)
+			return heuristicTokens(s)
+		}
+		return int(resp.TotalTokens)
+	}
+}
+
+// 内容を推定トークン数の上限ごとに行単位で分割する関数
+func splitByTokens(content string, limit int) []string {
+	if limit <= 0 || estimateTokens(content) <= limit {
+		return []string{content}
+	}
+	var chunks []string
+	var chunk strings.Builder
+	tokens := 0
+	var lines []string
+	for _, line := range strings.SplitAfter(content, "\n") {
+		// 1行だけで上限を超える場合は文字の境目で分ける（1文字は1トークン以下と見積もっている）
+		for estimateTokens(line) > limit {
+			piece, _ := truncateRunes(line, limit)
+			lines = append(lines, piece)
+			line = line[len(piece):]
+		}
+		lines = append(lines, line)
+	}
+	for _, line := range lines {
+		lineTokens := estimateTokens(line)
+		if tokens > 0 && tokens+lineTokens > limit {
+			chunks = append(chunks, chunk.String())
+			chunk.Reset()
+			tokens = 0
+		}
+		chunk.WriteString(line)
+		tokens += lineTokens
+	}
+	if chunk.Len() > 0 {
+		chunks = append(chunks, chunk.String())
+	}
+	return chunks
+}
+
+// 要約結果のキャッシュを置くディレクトリ（空ならキャッシュしない）
+// 途中で失敗しても、再実行時に要約済みのスライドは API を呼ばずに済む
+var cacheDir = ""
+
+// プロンプトからキャッシュファイルのパスを決める関数
+func cachePath(prompt string) string {
+	hash := sha256.Sum256([]byte(geminiModel + "\x00" + prompt))
+	return filepath.Join(cacheDir, hex.EncodeToString(hash[:])+".txt")
+}
+
+func readCache(prompt string) (string, bool) {
+	if cacheDir == "" {
+		return "", false
+	}
+	text, err := os.ReadFile(cachePath(prompt))
+	if err != nil {
+		return "", false
+	}
+	return string(text), true
+}
+
+func writeCache(prompt string, text string) {
+	if cacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		fmt.Println("[WARN] failed to create cache dir:", err)
+		return
+	}
+	if err := os.WriteFile(cachePath(prompt), []byte(text), 0644); err != nil {
+		fmt.Println("[WARN] failed to write cache:", err)
+	}
+}
+
+// 1スライド分の内容を Gemini で要約する関数
+// 内容が大きすぎる場合は分割して要約し、結果をつなげる
+func summarizeSlide(ctx context.Context, model *genai.GenerativeModel, slide *Slide) (string, error) {
+	parts := summaryParts(slide)
+	if len(parts) > 1 && !keepNesting {
+		fmt.Println("[WARN] slide is too large, split into", len(parts), "requests:", slide.Title)
+	}
+
+	var summary strings.Builder
+	for _, part := range parts {
+		// 前回の実行で要約済みならキャッシュを使う
+		if text, ok := readCache(part.prompt); ok {
+			summary.WriteString(part.finish(text))
+			continue
+		}
+		text, err := generateText(ctx, model, part.prompt)
+		if err != nil {
+			return "", err
+		}
+		writeCache(part.prompt, text)
+		summary.WriteString(part.finish(text))
+	}
+	return summary.String(), nil
+}
+
+// 1回のリクエストで要約する単位
+type summaryPart struct {
+	prompt   string
+	skeleton string // 入れ子を保つ箇条書きの元の形（空なら要約をそのまま使う）
+}
+
+// 要約結果を元の箇条書きの形に戻す
+func (p summaryPart) finish(text string) string {
+	if p.skeleton == "" {
+		return text
+	}
+	return applySkeleton(p.skeleton, text) + "\n"
+}
+
+// スライドを要約のリクエスト単位に分ける関数
+// 通常は大きすぎるスライドだけを分割し、keepNesting のときは最上位の箇条書きの項目ごとに分ける
+func summaryParts(slide *Slide) []summaryPart {
+	var parts []summaryPart
+	for _, chunk := range splitByTokens(slide.Content, maxSlideTokens) {
+		groups := []string{chunk}
+		if keepNesting {
+			groups = listGroups(chunk)
+		}
+		for _, group := range groups {
+			part := *slide
+			part.Content = group
+			summary := summaryPart{prompt: buildSummaryPrompt(&part)}
+			if keepNesting && isListGroup(group) {
+				summary.skeleton = group
+			}
+			parts = append(parts, summary)
+		}
+	}
+	return parts
+}
+
+// 箇条書きの項目の行（インデント、記号、本文）
+var nestedItemPattern = regexp.MustCompile(`^(\s*)([-*+•]|\d+[.)])\s+(.*)$`)
+
+// 箇条書きの項目で始まるまとまりか（nestedItemPattern は1行ずつにしか一致しないので最初の行で判定する）
+func isListGroup(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) != "" {
+			return nestedItemPattern.MatchString(line)
+		}
+	}
+	return false
+}
+
+// 本文を最上位の箇条書きの項目（入れ子の項目を含む）ごとにまとめる関数
+// 項目の文が元の行末で折り返されている場合は、項目でない行を前の行につなげて1項目1行に戻す
+func listGroups(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if nestedItemPattern.MatchString(line) || len(lines) == 0 {
+			lines = append(lines, line)
+			continue
+		}
+		// 英語の単語どうしのときだけ空白を補う
+		last := lines[len(lines)-1]
+		if last[len(last)-1] < utf8.RuneSelf && line[0] < utf8.RuneSelf && last[len(last)-1] != ' ' && line[0] != ' ' {
+			last += " "
+		}
+		lines[len(lines)-1] = last + line
+	}
+
+	var groups []string
+	for _, line := range lines {
+		if m := nestedItemPattern.FindStringSubmatch(line); len(groups) == 0 || (m != nil && m[1] == "") {
+			groups = append(groups, line)
+		} else {
+			groups[len(groups)-1] += "\n" + line
+		}
+	}
+	return groups
+}
+
+// 要約した箇条書きに元のインデントと記号を付け直す関数
+// 項目数が変わっていたら対応が取れないので要約をそのまま返す
+func applySkeleton(skeleton, summary string) string {
+	var items []string
+	for _, line := range strings.Split(summary, "\n") {
+		if m := nestedItemPattern.FindStringSubmatch(line); m != nil {
+			items = append(items, m[3])
+		}
+	}
+	original := strings.Split(skeleton, "\n")
+	if len(items) != len(original) {
+		return summary
+	}
+	for i, line := range original {
+		m := nestedItemPattern.FindStringSubmatch(line)
+		original[i] = fmt.Sprintf("%s%s %s", m[1], m[2], items[i])
+	}
+	return strings.Join(original, "\n")
+}
+
+// すべての分割分がキャッシュ済みならその要約を返す関数
+func cachedSummary(slide *Slide) (string, bool) {
+	if cacheDir == "" {
+		return "", false
+	}
+	var summary strings.Builder
+	for _, part := range summaryParts(slide) {
+		text, ok := readCache(part.prompt)
+		if !ok {
+			return "", false
+		}
+		summary.WriteString(part.finish(text))
+	}
+	return summary.String(), true
+}
+
+// 要約前の本文を発表者ノートに残すか
+var sourceNotes = false
+
+// 画像のプレースホルダー（ノートでは画像を出さない）
+var imagePlaceholderPattern = regexp.MustCompile(`\{\{IMAGE\d+\}\}`)
+
+// 要約前の本文を発表者ノートにする関数
+// 数式とコードは元に戻し、コメントを閉じてしまう --> は崩しておく
+func sourceNote(slide *Slide) string {
+	note := restoreMath(slide.restoreCode(imagePlaceholderPattern.ReplaceAllString(slide.Content, "")))
+	note = strings.ReplaceAll(note, "-->", "-- >")
+	return strings.TrimSpace(trimTrailingSpace(note))
+}
+
+// 要約結果をスライドに反映する関数
+func applySummary(slide *Slide, summary string) {
+	if sourceNotes {
+		if note := sourceNote(slide); note != "" {
+			slide.Notes = append(slide.Notes, note)
+		}
+	}
+	// 応答全体がコードフェンスで囲まれていたら外す
+	summary = stripOuterFence(summary)
+	// 応答の行末の空白で意図しない改行が起きないようにする
+	summary = trimTrailingSpace(summary)
+	// 指示を無視して箇条書きが多すぎる場合は切り詰める
+	if bulletsPerSlide > 0 {
+		summary = fitBullets(summary, bulletsPerSlide)
+	} else {
+		summary = trimBullets(summary, maxBullets)
+	}
+	slide.Content = summary
+}
+
+// 1枚のスライドの要約にかける時間の上限（再送の待ち時間を含む、0 なら制限なし）
+// 再送を繰り返すスライドがあってもバッチ全体が止まらないようにする
+var slideTimeout = 3 * time.Minute
+
+// 1枚のスライドを要約して反映する関数
+// 時間内に要約できなければ Failed を立て、元の内容のまま残す
+func summarizeWithTimeout(ctx context.Context, model *genai.GenerativeModel, slide *Slide, index int) {
+	if slideTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, slideTimeout)
+		defer cancel()
+	}
+	// Gemini API を使用してコンテンツを最適化
+	fmt.Println("[send] index:", index)
+	summary, err := summarizeSlide(ctx, model, slide)
+	if err != nil {
+		slide.Failed = true
+		fmt.Fprintln(os.Stderr, "[ERROR] at index:", index, "\n", err)
+		return
+	}
+	// レスポンスをスライドに代入
+	applySummary(slide, summary)
+}
+
+// Gemini でページごとの内容をスライドっぽくする
+func analyzeContentWithGemini(slides []*Slide) ([]*Slide, error) {
+	ctx := context.Background()
+
+	loadEnv()
+
+	// Gemini APIクライアントを作成する
+	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	// Gemini のモデル指定
+	model := client.GenerativeModel(geminiModel)
+	model.SafetySettings = safetySettings
+	if exactTokens {
+		estimateTokens = countTokensWith(ctx, model)
+		defer func() { estimateTokens = heuristicTokens }()
+	}
+
+	// 範囲指定がある場合はその範囲のスライドだけ要約する
+	targets := selectSlideRange(slides)
+
+	// 前回の実行で要約済みのスライドは API を呼ばずに反映し、残りだけ送る
+	var pending []*Slide
+	for _, slide := range targets {
+		// 本文のないスライド（結合時の区切りのスライドなど）は送らない
+		if strings.TrimSpace(slide.Content) == "" {
+			continue
+		}
+		if summary, ok := cachedSummary(slide); ok {
+			applySummary(slide, summary)
+			continue
+		}
+		pending = append(pending, slide)
+	}
+	if len(pending) < len(targets) {
+		fmt.Println("[cache] reused:", len(targets)-len(pending))
+	}
+	targets = pending
+
+	// スライドを1分あたりのリクエスト数ごとに分割する
+	fmt.Println("[slide length]:", len(targets))
+	pace := newPacing(requestsPerMinute, tokensPerMinute)
+	batches := splitBatches(targets, pace)
+
+	for j, batch := range batches {
+		var wg sync.WaitGroup
+
+		fmt.Println() // ログを見やすくするために改行
+		for i := batch.start; i < batch.end; i++ {
+			slide := targets[i]
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				summarizeWithTimeout(ctx, model, slide, i)
+			}()
+		}
+		wg.Wait()
+		if j != len(batches)-1 && requestBudgetExhausted() {
+			// 残りのスライドは要約せずに元の内容のまま出力する
+			fmt.Fprintln(os.Stderr, "[ERROR] request budget of", maxRequests, "reached; the remaining slides are not summarized")
+			break
+		}
+		if j != len(batches)-1 {
+			time.Sleep(pace.delay)
+		}
+	}
+
+	failed := 0
+	for _, slide := range targets {
+		if slide.Failed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintln(os.Stderr, "[ERROR]", failed, "slide(s) could not be summarized and are left as written")
+	}
+
+	return slides, nil
+}
+
+// プロンプトを送る関数（テストでは Gemini を呼ばないものに差し替える）
+var generateContent = func(ctx context.Context, model *genai.GenerativeModel, prompt string) (*genai.GenerateContentResponse, error) {
+	return model.GenerateContent(ctx, genai.Text(prompt))
+}
+
+// スライドの配列の中の1バッチ分の範囲（start 以上 end 未満の添字）
+// 部分スライスを持ち回らず、元の配列を添字で参照する
+type batchRange struct {
+	start, end int
+}
+
+// スライドをバッチに分ける関数
+// 1バッチのリクエスト数と推定トークン数の合計がどちらも上限を超えないように前から詰める
+// 1枚で上限を超えるスライドはそれだけで1バッチにする
+func splitBatches(slides []*Slide, pace pacing) []batchRange {
+	var batches []batchRange
+	start, requests, tokens := 0, 0, 0
+	for i, slide := range slides {
+		slideRequests, slideTokens := 0, 0
+		for _, part := range summaryParts(slide) {
+			slideRequests++
+			slideTokens += estimateTokens(part.prompt)
+		}
+		if i > start && (requests+slideRequests > pace.batchSize || tokens+slideTokens > pace.batchTokens) {
+			batches = append(batches, batchRange{start: start, end: i})
+			start, requests, tokens = i, 0, 0
+		}
+		requests += slideRequests
+		tokens += slideTokens
+	}
+	if start < len(slides) {
+		batches = append(batches, batchRange{start: start, end: len(slides)})
+	}
+	return batches
+}
+
+// 冒頭・末尾に入れる固定スライド
+var introSlides []*Slide
+var outroSlides []*Slide
+
+// 固定スライド用のマークダウンを読み込む関数
+// --- の行でページを分け、内容はそのままスライドにする
+func loadFixedSlides(path string) ([]*Slide, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to read fixed slide file: %w", err)
+	}
+	content = stripBOM(content)
+
+	var fixedSlides []*Slide
+	var page []string
+	flush := func() {
+		if text := strings.TrimSpace(strings.Join(page, "\n")); text != "" {
+			fixedSlides = append(fixedSlides, &Slide{Content: text})
+		}
+		page = nil
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "---" {
+			flush()
+			continue
+		}
+		page = append(page, line)
+	}
+	flush()
+	return fixedSlides, nil
+}
+
+// 発表者ノートを別ファイル（<name>_notes.md）に出力するか
+var separateNotes = false
+
+// スライドのサイズ（Marp の組み込みテーマが対応している比率、空ならテーマの既定）
+var slideSize = ""
+
+// Marp CLI で PDF に書き出す前提の出力にするか
+// ページ番号を付けて比率を固定し、PDF で描画されない生の HTML は文字にする
+var pdfMode = false
+
+// PDF で実行も表示もされない要素（中身ごと消す）と HTML タグ
+var htmlDropPattern = regexp.MustCompile(`(?is)<(script|style|iframe)\b.*?</(script|style|iframe)\s*>`)
+var htmlTagPattern = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// HTML をタグを外した文字にする関数
+func htmlToText(htmlText string) string {
+	htmlText = htmlDropPattern.ReplaceAllString(htmlText, "")
+	return strings.TrimSpace(htmlTagPattern.ReplaceAllString(htmlText, ""))
+}
+
+var supportedSizes = []string{"16:9", "4:3"}
+
+// 元の記事のタグを出す場所（footer: 全ページのフッター、title: タイトルスライド、空なら出さない）
+var tagPlacement = ""
+
+// タグを "#go #marp" の形にする関数（行頭でも見出しにならないようエスケープする）
+func formatTags(tags []string) string {
+	var formatted []string
+	for _, tag := range tags {
+		formatted = append(formatted, "\\#"+tag)
+	}
+	return strings.Join(formatted, " ")
+}
+
+// フロントマターに追加する Marp のディレクティブ
+var extraFrontMatter = frontMatterFlag{}
+
+// -front-matter で "key: value" を繰り返し指定できるようにする
+type frontMatterFlag map[string]string
+
+func (f frontMatterFlag) String() string {
+	return fmt.Sprint(map[string]string(f))
+}
+
+func (f frontMatterFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("front matter must be \"key: value\": %s", value)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" || key == "marp" {
+		return fmt.Errorf("front matter key %q cannot be set", key)
+	}
+	f[key] = strings.TrimSpace(val)
+	return nil
+}
+
+// テーマのフロントマターに追加のディレクティブを合わせる関数
+// 同じキーがあれば追加の方で上書きする
+func mergeFrontMatter(theme string, extra map[string]string) string {
+	if len(extra) == 0 {
+		return theme
+	}
+	var merged strings.Builder
+	merged.WriteString("\n")
+	for _, line := range strings.Split(strings.Trim(theme, "\n"), "\n") {
+		key, _, _ := strings.Cut(line, ":")
+		if _, ok := extra[strings.TrimSpace(key)]; !ok {
+			merged.WriteString(line + "\n")
+		}
+	}
+	keys := slices.Sorted(maps.Keys(extra))
+	for _, key := range keys {
+		merged.WriteString(fmt.Sprintf("%s: %s\n", key, extra[key]))
+	}
+	return merged.String()
+}
+
+// 組み込みのテーマの代わりに使う Marp のテーマ名と、その CSS（ファイルまたは URL、空なら名前だけ指定）
+var themeName, themeCSS = "", ""
+
+// フロントマターの style に入れるテーマの CSS（main で themeCSS から作る）
+var themeStyle = ""
+
+// CSS の識別子として使える名前か（テーマ名は CSS の /* @theme name */ と一致させる必要がある）
+var cssIdentifierPattern = regexp.MustCompile(`^-?[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// テーマの CSS をフロントマターの style に入れる形にする関数
+// URL はそのまま読み込ませ、ファイルは中身を埋め込む
+func loadThemeStyle(source string) (string, error) {
+	css := fmt.Sprintf("@import url(%q);", source)
+	if !isURL(source) {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return "", fmt.Errorf("[ERROR] failed to read theme CSS: %w", err)
+		}
+		css = strings.TrimSpace(string(data))
+	}
+	// YAML のブロックスカラーとして書けるように各行を字下げする
+	var style strings.Builder
+	style.WriteString("|")
+	for _, line := range strings.Split(css, "\n") {
+		style.WriteString("\n  " + strings.TrimRight(line, " \t\r"))
+	}
+	return style.String(), nil
+}
+
+// タイトルをスライドに埋め込めるようにする関数
+// 生成したタイトルの末尾の改行や途中の改行は空白にし、HTML として解釈される文字をエスケープする
+// 元から &amp; のような文字参照で書かれていれば一度戻してからエスケープし、二重にならないようにする
+var titleEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func escapeTitle(title []byte) string {
+	return titleEscaper.Replace(html.UnescapeString(strings.Join(strings.Fields(string(title)), " ")))
+}
+
+// タイトルスライドのサブタイトル、発表者、日付（空なら出さない）
+var subtitle, author, date = "", "", ""
+
+// タイトルの下に出すサブタイトルと発表者・日付の行を返す関数
+func titleDetails() string {
+	var details strings.Builder
+	if subtitle != "" {
+		details.WriteString("\n" + escapeTitle([]byte(subtitle)) + "\n")
+	}
+	var byline []string
+	for _, s := range []string{author, date} {
+		if s != "" {
+			byline = append(byline, escapeTitle([]byte(s)))
+		}
+	}
+	if len(byline) > 0 {
+		details.WriteString("\n" + strings.Join(byline, " / ") + "\n")
+	}
+	return details.String()
+}
+
+// 見出しのレベルごとに付ける Marp のクラス（例: 1=lead、複数指定可）
+type levelClassFlag map[int]string
+
+var levelClasses = levelClassFlag{}
+
+func (f levelClassFlag) String() string {
+	return fmt.Sprint(map[int]string(f))
+}
+
+func (f levelClassFlag) Set(value string) error {
+	level, class, ok := strings.Cut(value, "=")
+	n, err := strconv.Atoi(strings.TrimSpace(level))
+	if !ok || err != nil || n < 1 || n > 4 {
+		return fmt.Errorf("level class must be \"N=class\" with N from 1 to 4: %s", value)
+	}
+	f[n] = strings.TrimSpace(class)
+	return nil
+}
+
+// スライドに付ける Marp のクラスを返す関数
+// <!-- _class: ... --> の指定があればそちらを優先し、なければ見出しのレベルで決める
+func (s *Slide) marpClass() string {
+	if s.Class != "" {
+		return s.Class
+	}
+	return levelClasses[s.Level]
+}
+
+// marpタグを冒頭に追加、ページの分かれたスライドを連結
+func convertToMarp(slides []*Slide, title []byte, style int) string {
+	var marpBuilder strings.Builder
+	marpBuilder.WriteString("---\nmarp: true") // Marpタグ
+	directives := maps.Clone(extraFrontMatter)
+	if slideSize != "" {
+		directives["size"] = slideSize
+	}
+	if pdfMode {
+		directives["paginate"] = "true"
+		if slideSize == "" {
+			directives["size"] = "16:9"
+		}
+	}
+	if tagPlacement == "footer" && len(documentTags) > 0 {
+		directives["footer"] = strconv.Quote(formatTags(documentTags))
+	}
+	if themeName != "" {
+		directives["theme"] = themeName
+	}
+	if themeStyle != "" {
+		directives["style"] = themeStyle
+	}
+	marpBuilder.WriteString(mergeFrontMatter(styles.ThemeList[style], directives))
 	marpBuilder.WriteString("---\n# ")
-	marpBuilder.WriteString(string(title))
+	marpBuilder.WriteString(escapeTitle(title))
 	marpBuilder.WriteString("\n")
+	marpBuilder.WriteString(titleDetails())
+	if tagPlacement == "title" && len(documentTags) > 0 {
+		marpBuilder.WriteString("\n" + formatTags(documentTags) + "\n\n")
+	}
 	marpBuilder.WriteString("<style scoped>section{font-size:50px;text-align:center}</style>")
 
-	for _, slide := range slides {
-		marpBuilder.WriteString("\n---\n")
-		marpBuilder.WriteString(fmt.Sprintf("# %s\n\n", slide.Title))
-		marpBuilder.WriteString(fmt.Sprintf("%s\n", slide.Content))
+	// 冒頭・末尾の固定スライドは Gemini を通さずそのまま連結
+	allSlides := slices.Concat(introSlides, orderSlides(slides), outroSlides)
+	titles := disambiguateTitles(allSlides)
+	if tocMode != "" {
+		marpBuilder.WriteString("\n---\n# 目次\n\n")
+		marpBuilder.WriteString(buildTOC(allSlides, titles, len(introSlides), len(introSlides)+len(slides), tocMode == "links"))
+	}
+	for j, slide := range allSlides {
+		marpBuilder.WriteString("\n---\n")
+		if class := slide.marpClass(); class != "" {
+			marpBuilder.WriteString(fmt.Sprintf("<!-- _class: %s -->\n", class))
+		}
+		if titles[j] != "" {
+			marpBuilder.WriteString(fmt.Sprintf("# %s%s", titles[j], headingSeparator))
+		}
+		if sourceLines && slide.Line > 0 {
+			marpBuilder.WriteString(fmt.Sprintf("<!-- source: line %d -->\n\n", slide.Line))
+		}
+		if slide.WideTable {
+			marpBuilder.WriteString("<style scoped>table{font-size:60%}</style>\n\n")
+		}
+		texts, images := slide.splitAtImages(slide.body())
+		marpBuilder.WriteString(texts[0])
+		marpBuilder.WriteString(timingHint(strings.Join(texts, "")))
+		// 別ファイルに出さない場合は Marp の発表者ノート（コメント）として残す
+		if !separateNotes {
+			for _, note := range slide.Notes {
+				marpBuilder.WriteString(fmt.Sprintf("\n<!--\n%s\n-->\n", note))
+			}
+		}
+		// 分離しておいた画像を元の位置に1枚ずつ入れ、続きの本文は同じ見出しの次のページに置く
+		for i, image := range images {
+			marpBuilder.WriteString(fmt.Sprintf("\n---\n%s\n", image.directive()))
+			if strings.TrimSpace(texts[i+1]) != "" {
+				marpBuilder.WriteString("\n---\n")
+				if class := slide.marpClass(); class != "" {
+					marpBuilder.WriteString(fmt.Sprintf("<!-- _class: %s -->\n", class))
+				}
+				if titles[j] != "" {
+					marpBuilder.WriteString(fmt.Sprintf("# %s%s", titles[j], headingSeparator))
+				}
+				marpBuilder.WriteString(texts[i+1])
+			}
+		}
+	}
+
+	return marpBuilder.String()
+}
+
+// 各スライドに元のマークダウンの見出しの行番号をコメントで入れるか
+var sourceLines = false
+
+// <!-- order: N --> の指定に合わせてスライドを並べ替える関数
+// 指定のあるスライドを N 番目に置き、指定のないスライドは元の並びのまま残りの位置を埋める
+// 指定が重なったり枚数を超えたりした場合は、指定のあるスライドどうしの順番だけ保つ
+func orderSlides(slides []*Slide) []*Slide {
+	var annotated, rest []*Slide
+	for _, slide := range slides {
+		if slide.Order > 0 {
+			annotated = append(annotated, slide)
+		} else {
+			rest = append(rest, slide)
+		}
+	}
+	slices.SortStableFunc(annotated, func(a, b *Slide) int {
+		return a.Order - b.Order
+	})
+	result := make([]*Slide, 0, len(slides))
+	for _, slide := range annotated {
+		for len(result) < slide.Order-1 && len(rest) > 0 {
+			result = append(result, rest[0])
+			rest = rest[1:]
+		}
+		result = append(result, slide)
+	}
+	return append(result, rest...)
+}
+
+// タイトルの次に目次のスライドを入れるか（"" は入れない、"list" は一覧のみ、"links" は各ページへのリンク付き）
+var tocMode = ""
+
+// 本文のスライド（allSlides[first:last]）の見出しを目次の箇条書きにする関数
+// 見出しのレベルに合わせて字下げし、リンク付きのときは Marp のページ番号のアンカー（#3 など）を付ける
+func buildTOC(allSlides []*Slide, titles []string, first, last int, links bool) string {
+	minLevel := 0
+	for _, slide := range allSlides[first:last] {
+		if slide.Level > 0 && (minLevel == 0 || slide.Level < minLevel) {
+			minLevel = slide.Level
+		}
+	}
+	var toc strings.Builder
+	page := 3 // タイトルと目次の次のページから
+	for j, slide := range allSlides {
+		if j >= first && j < last && titles[j] != "" {
+			indent := strings.Repeat("  ", max(0, slide.Level-minLevel))
+			if links {
+				toc.WriteString(fmt.Sprintf("%s- [%s](#%d)\n", indent, titles[j], page))
+			} else {
+				toc.WriteString(fmt.Sprintf("%s- %s\n", indent, titles[j]))
+			}
+		}
+		page += slide.pageCount()
+	}
+	return toc.String()
+}
+
+// 同名の見出しの区別の仕方（"" は区別しない、"counter" は番号、"parent" は親の見出しを付ける）
+var dedupeTitles = ""
+
+// 同名の見出しを区別したスライドのタイトルを返す関数
+// 2回目以降に出てきた見出しに "Example (2)" のような番号か "Example - 親の見出し" を付ける
+func disambiguateTitles(slides []*Slide) []string {
+	titles := make([]string, len(slides))
+	seen := make(map[string]int)
+	for i, slide := range slides {
+		titles[i] = slide.Title
+		if dedupeTitles == "" || slide.Title == "" {
+			continue
+		}
+		seen[slide.Title]++
+		if seen[slide.Title] == 1 {
+			continue
+		}
+		// 親の見出しでも区別できなければ番号を付ける
+		withParent := fmt.Sprintf("%s - %s", slide.Title, slide.Parent)
+		if dedupeTitles == "parent" && slide.Parent != "" && seen[withParent] == 0 {
+			titles[i] = withParent
+			seen[withParent]++
+		} else {
+			titles[i] = fmt.Sprintf("%s (%d)", slide.Title, seen[slide.Title])
+		}
+	}
+	return titles
+}
+
+// 発表時間の目安を出すときの1分あたりの単語数（0 なら出さない）
+var timingWPM = 0
+
+// 本文を読み上げるのにかかる秒数を推定する関数
+// 英語は空白区切りの単語、日本語などは2文字を1語として数える
+func speakingSeconds(text string, wpm int) int {
+	words, chars := 0, 0
+	for _, field := range strings.Fields(text) {
+		ascii := false
+		for _, r := range field {
+			if r < utf8.RuneSelf {
+				ascii = true
+			} else {
+				chars++
+			}
+		}
+		if ascii {
+			words++
+		}
+	}
+	words += (chars + 1) / 2
+	return (words*60 + wpm - 1) / wpm
+}
+
+// スライドの発表時間の目安のコメントを返す関数
+func timingHint(text string) string {
+	if timingWPM <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n<!-- ~%ds -->\n", speakingSeconds(text, timingWPM))
+}
+
+// 見出しと本文の間に入れる文字列
+var headingSeparator = "\n\n"
+
+// 本文の最初の行をリードとして装飾するテンプレート（%s に行が入る、空なら装飾しない）
+var leadTemplate = ""
+
+// 本文の最初の行にリードのテンプレートを適用する関数
+// コードや数式のプレースホルダーの行は対象にしない
+func applyLead(content string) string {
+	if leadTemplate == "" {
+		return content
+	}
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "{{") {
+			continue
+		}
+		// テンプレートの CSS に % があっても崩れないよう、書式指定ではなく置換で入れる
+		lines[i] = strings.Replace(leadTemplate, "%s", trimmed, 1)
+		break
+	}
+	return strings.Join(lines, "\n")
+}
+
+// スライド本文を出力用に組み立てる
+// 退避していたコードブロックと数式をここで元に戻す
+// 要約の有無にかかわらず、本文中の区切り線で意図しない改ページが起きないようにする
+func (s *Slide) body() string {
+	content := s.restoreCode(escapeSlideSeparators(applyLead(s.Content)))
+	// 要約でプレースホルダーが消えた数式ブロックは末尾に付け足す
+	for _, math := range s.Math {
+		if !strings.Contains(content, math) {
+			content += "\n" + math + "\n"
+		}
+	}
+	return restoreMath(content) + "\n"
+}
+
+// スライドの出力形式
+type Renderer interface {
+	Render(slides []*Slide, title []byte, style int) string
+	Suffix() string // 出力ファイル名の末尾
+}
+
+// Marp 形式で出力する
+type MarpRenderer struct{}
+
+func (MarpRenderer) Render(slides []*Slide, title []byte, style int) string {
+	return convertToMarp(slides, title, style)
+}
+
+func (MarpRenderer) Suffix() string {
+	return "_marp.md"
+}
+
+// reveal.js のマークダウン形式で出力する
+// 分離した画像ページは元のスライドの下に縦方向（--）のサブスライドとして置く
+type RevealRenderer struct{}
+
+func (RevealRenderer) Render(slides []*Slide, title []byte, style int) string {
+	var revealBuilder strings.Builder
+	revealBuilder.WriteString("---\n")
+	revealBuilder.WriteString(fmt.Sprintf("title: %s\n", strconv.Quote(escapeTitle(title))))
+	revealBuilder.WriteString(styles.RevealThemeList[style])
+	revealBuilder.WriteString("---\n\n# ")
+	revealBuilder.WriteString(escapeTitle(title))
+	revealBuilder.WriteString("\n")
+	revealBuilder.WriteString(titleDetails())
+
+	allSlides := slices.Concat(introSlides, orderSlides(slides), outroSlides)
+	titles := disambiguateTitles(allSlides)
+	if tocMode != "" {
+		// reveal.js はページ番号のアンカーが Marp と違うので一覧だけにする
+		revealBuilder.WriteString("\n---\n\n## 目次\n\n")
+		revealBuilder.WriteString(buildTOC(allSlides, titles, len(introSlides), len(introSlides)+len(slides), false))
+	}
+	for j, slide := range allSlides {
+		revealBuilder.WriteString("\n---\n\n")
+		if class := slide.marpClass(); class != "" {
+			revealBuilder.WriteString(fmt.Sprintf("<!-- .slide: class=\"%s\" -->\n\n", class))
+		}
+		if titles[j] != "" {
+			revealBuilder.WriteString(fmt.Sprintf("## %s%s", titles[j], headingSeparator))
+		}
+		texts, images := slide.splitAtImages(slide.body())
+		revealBuilder.WriteString(texts[0])
+		revealBuilder.WriteString(timingHint(strings.Join(texts, "")))
+		// reveal.js の発表者ノートは Note: 以降に書く
+		if !separateNotes && len(slide.Notes) > 0 {
+			revealBuilder.WriteString("\nNote:\n" + strings.Join(slide.Notes, "\n\n") + "\n")
+		}
+		for i, image := range images {
+			revealBuilder.WriteString(fmt.Sprintf("\n--\n\n![](%s)\n", image.Src))
+			if image.Caption != "" {
+				revealBuilder.WriteString(fmt.Sprintf("\n*%s*\n", image.Caption))
+			}
+			if strings.TrimSpace(texts[i+1]) != "" {
+				revealBuilder.WriteString("\n--\n\n" + texts[i+1])
+			}
+		}
+	}
+
+	return revealBuilder.String()
+}
+
+func (RevealRenderer) Suffix() string {
+	return "_reveal.md"
+}
+
+// -target で選べる出力形式
+var renderers = map[string]Renderer{
+	"marp":   MarpRenderer{},
+	"reveal": RevealRenderer{},
+}
+var target = "marp"
+
+// 発表者ノートをスライド番号ごとにまとめる関数
+// 番号はタイトルスライドを除いた本文スライドの通し番号
+func convertToNotes(slides []*Slide) string {
+	var notesBuilder strings.Builder
+	notesBuilder.WriteString("# Notes\n")
+	for i, slide := range slides {
+		if len(slide.Notes) == 0 {
+			continue
+		}
+		notesBuilder.WriteString(fmt.Sprintf("\n## %d. %s\n\n", i+1, slide.Title))
+		notesBuilder.WriteString(strings.Join(slide.Notes, "\n\n") + "\n")
+	}
+	return notesBuilder.String()
+}
+
+// 要約前のスライドを書き出すファイル（空なら書き出さない）
+var dumpIntermediate = ""
+
+// パース直後（Gemini に渡す前）のスライドをマークダウンにまとめる関数
+// パーサーの結果を AI の出力と切り分けて確認するためのもの
+func convertToIntermediate(slides []*Slide) string {
+	var dumpBuilder strings.Builder
+	for i, slide := range slides {
+		dumpBuilder.WriteString(fmt.Sprintf("<!-- slide %d -->\n## %s\n\n", i+1, slide.Title))
+		texts, images := slide.splitAtImages(slide.body())
+		dumpBuilder.WriteString(texts[0])
+		for i, image := range images {
+			dumpBuilder.WriteString(fmt.Sprintf("\n![%s](%s)\n", image.Caption, image.Src))
+			dumpBuilder.WriteString(texts[i+1])
+		}
+		for _, note := range slide.Notes {
+			dumpBuilder.WriteString(fmt.Sprintf("\n<!--\n%s\n-->\n", note))
+		}
+		dumpBuilder.WriteString("\n")
+	}
+	return dumpBuilder.String()
+}
+
+// func deleteEscape(content []byte) (result []byte) {
+// 	strc := string(content)
+// 	decryed, err := base64.StdEncoding.DecodeString(strc)
+// 	if err != nil {
+// 		fmt.Println("[ERROR] decode failed", err)
+// 	}
+
+// 	unescaped, err := strconv.Unquote(string(decryed))
+// 	if err != nil {
+// 		fmt.Println("[ERROR] unquote failed", err)
+// 	}
+// 	result = []byte(unescaped)
+// 	return result
+// }
+
+// CountSlides でスライドを分けるときの設定（同じ名前のフラグと同じ意味）
+type Options struct {
+	Extensions string   // goldmark の拡張（-extensions、空なら gfm）
+	Section    string   // この見出しとその下の階層だけを数える（-section、空なら文書全体）
+	Intro      []*Slide // 冒頭の固定スライド（-intro）
+	Outro      []*Slide // 末尾の固定スライド（-outro）
+}
+
+// フラグで指定された今の設定を Options にまとめる関数
+func currentOptions() Options {
+	return Options{Extensions: markdownExtensions, Section: sectionName, Intro: introSlides, Outro: outroSlides}
+}
+
+// Gemini を使わずに生成されるスライド数を数える関数
+// タイトルスライドと分離した画像のページは含めず、固定スライドは含める
+func CountSlides(content []byte, opts Options) (int, error) {
+	// parseMarkdown はフラグの変数を見て分けるので、数える間だけ opts の設定に差し替える
+	savedExtensions, savedSection := markdownExtensions, sectionName
+	defer func() { markdownExtensions, sectionName = savedExtensions, savedSection }()
+	markdownExtensions, sectionName = opts.Extensions, opts.Section
+	if markdownExtensions == "" {
+		markdownExtensions = "gfm"
+	}
+
+	slides, err := parseMarkdown(content)
+	if err != nil {
+		return 0, err
+	}
+	return len(opts.Intro) + len(slides) + len(opts.Outro), nil
+}
+
+// Gemini を使わずに変換できるかを確かめる関数
+// スライド数と、変換はできるが結果が崩れそうな問題の一覧を返す
+func CheckMarkdown(content []byte) (int, []string, error) {
+	slides, err := parseMarkdown(content)
+	if err != nil {
+		return 0, nil, err
+	}
+	problems := slices.Clone(parseWarnings)
+	headings := 0
+	for _, slide := range slides {
+		if slide.Level == 0 {
+			continue
+		}
+		headings++
+		if strings.TrimSpace(slide.Title) == "" {
+			problems = append(problems, fmt.Sprintf("empty heading at line %d", slide.Line))
+		}
+	}
+	if headings == 0 {
+		problems = append(problems, "no headings found; the whole document becomes a single slide")
+	}
+	return len(introSlides) + len(slides) + len(outroSlides), problems, nil
+}
+
+// Marp の directive コメント（<!-- _class: lead --> など）とスコープ付きのスタイル
+var marpDirectivePattern = regexp.MustCompile(`^<!--\s*_?[A-Za-z]+\s*:.*-->$`)
+var scopedStylePattern = regexp.MustCompile(`(?s)<style scoped>.*?</style>`)
+var backgroundImagePattern = regexp.MustCompile(`^!\[bg[^\]]*\]\((.*)\)$`)
+
+// Marp のファイルを元の内容のマークダウンに戻す関数
+// フロントマター、ページ区切り、directive、スコープ付きのスタイルを取り除き、背景画像は普通の画像にする
+func MarpToMarkdown(marp string) (string, error) {
+	text := strings.ReplaceAll(marp, "\r\n", "\n")
+	if strings.TrimSpace(text) == "" {
+		return "", fmt.Errorf("[ERROR] empty Marp input")
+	}
+	if strings.HasPrefix(text, "---\n") {
+		_, body, found := strings.Cut(text[len("---\n"):], "\n---\n")
+		if !found {
+			return "", fmt.Errorf("[ERROR] unterminated front matter")
+		}
+		text = body
 	}
+	text = scopedStylePattern.ReplaceAllString(text, "")
 
-	return marpBuilder.String()
+	var pages []string
+	var page []string
+	inFence := false
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			inFence = !inFence
+		}
+		switch {
+		case inFence || strings.HasPrefix(trimmed, "```"):
+			page = append(page, line)
+		case separatorPattern.MatchString(line):
+			pages = append(pages, strings.TrimSpace(strings.Join(page, "\n")))
+			page = nil
+		case marpDirectivePattern.MatchString(trimmed):
+			continue
+		case backgroundImagePattern.MatchString(trimmed):
+			page = append(page, backgroundImagePattern.ReplaceAllString(trimmed, "![]($1)"))
+		default:
+			page = append(page, line)
+		}
+	}
+	pages = append(pages, strings.TrimSpace(strings.Join(page, "\n")))
+
+	// 画像で分かれた続きのページは同じ見出しを繰り返しているので1つにする
+	var result []string
+	lastHeading := ""
+	for _, page := range pages {
+		first, rest, _ := strings.Cut(page, "\n")
+		if strings.HasPrefix(first, "#") {
+			if first == lastHeading {
+				page = strings.TrimSpace(rest)
+			}
+			lastHeading = first
+		}
+		if page != "" {
+			result = append(result, page)
+		}
+	}
+	return collapseBlankLineRuns(strings.Join(result, "\n\n")) + "\n", nil
 }
 
-// func deleteEscape(content []byte) (result []byte) {
-// 	strc := string(content)
-// 	decryed, err := base64.StdEncoding.DecodeString(strc)
-// 	if err != nil {
-// 		fmt.Println("[ERROR] decode failed", err)
-// 	}
+// 複数の入力を1つのデッキにまとめるときに、ファイルごとに区切りのスライドを入れるか
+var combineDividers = false
 
-// 	unescaped, err := strconv.Unquote(string(decryed))
-// 	if err != nil {
-// 		fmt.Println("[ERROR] unquote failed", err)
-// 	}
-// 	result = []byte(unescaped)
-// 	return result
-// }
+// 複数のマークダウンを1つの文書につなげる関数
+// 2つ目以降のフロントマターは取り除き（タグは最初のファイルのものを使う）、
+// 区切りを入れる場合はファイル名の見出しとリードのクラスを持つスライドを各ファイルの前に置く
+func combineMarkdown(names []string, contents [][]byte) []byte {
+	var combined bytes.Buffer
+	for i, content := range contents {
+		frontMatter, body := splitFrontMatter(content)
+		if i == 0 && frontMatter != "" {
+			combined.WriteString("---\n" + frontMatter + "\n---\n")
+		}
+		if combineDividers {
+			combined.WriteString(fmt.Sprintf("\n# %s\n\n<!-- _class: lead -->\n\n", path.Base(names[i])))
+		}
+		combined.Write(body)
+		combined.WriteString("\n\n")
+	}
+	return combined.Bytes()
+}
+
+// 出力の3行以上続く空行を1行にまとめるか
+var collapseBlankLines = true
+
+// 3行以上続く空行を1行にまとめる関数
+// コードブロック内の空行はそのまま残す
+func collapseBlankLineRuns(s string) string {
+	var result []string
+	blank := 0
+	inFence := false
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+		}
+		if !inFence && strings.TrimSpace(line) == "" {
+			blank++
+			continue
+		}
+		if blank >= 3 {
+			blank = 1
+		}
+		for ; blank > 0; blank-- {
+			result = append(result, "")
+		}
+		result = append(result, line)
+	}
+	// 末尾の空行は1行だけ残す
+	if blank > 0 {
+		result = append(result, "")
+	}
+	return strings.Join(result, "\n")
+}
+
+// 出力前に最終的なスライドへ順番に適用する変換
+var finalizers []func(string) string
+
+// 出力前の変換を追加する関数（追加した順に適用される）
+func AddFinalizer(finalize func(string) string) {
+	finalizers = append(finalizers, finalize)
+}
+
+// 箇条書きの記号とその後の空白、区切り線
+var unorderedMarkerPattern = regexp.MustCompile(`^(\s*)[-*+]\s+`)
+var orderedMarkerPattern = regexp.MustCompile(`^(\s*)(\d+[.)])\s+`)
+var thematicBreakPattern = regexp.MustCompile(`^\s*([-*_])(\s*[-*_])+\s*$`)
+
+// 出力のマークダウンの書き方をそろえる関数（-format）
+// 箇条書きの記号を - にし、記号の後の空白を1つにして、行末の空白を取り除く
+// コードブロックの中と区切り線（* * * など）はそのまま残す
+func formatMarkdown(s string) string {
+	lines := strings.Split(s, "\n")
+	inFence := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence || thematicBreakPattern.MatchString(line) {
+			continue
+		}
+		line = strings.TrimRight(line, " \t")
+		line = unorderedMarkerPattern.ReplaceAllString(line, "$1- ")
+		line = orderedMarkerPattern.ReplaceAllString(line, "$1$2 ")
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// -replace で "pattern=>replacement" の正規表現置換を出力前の変換として追加する
+type replaceFlag struct{}
+
+func (replaceFlag) String() string {
+	return ""
+}
+
+func (replaceFlag) Set(value string) error {
+	pattern, replacement, ok := strings.Cut(value, "=>")
+	if !ok {
+		return fmt.Errorf("replace must be \"pattern=>replacement\": %s", value)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	AddFinalizer(func(s string) string {
+		return re.ReplaceAllString(s, replacement)
+	})
+	return nil
+}
+
+// 変換結果
+type Result struct {
+	Title  string        `json:"title"`           // スライドのタイトル（生成した場合は生成結果）
+	Slides []ResultSlide `json:"slides"`          // 要約後の各スライド
+	Marp   string        `json:"marp"`            // 出力するスライド
+	Notes  string        `json:"notes,omitempty"` // 別ファイルに出す発表者ノート（-notes-file のときのみ）
+}
 
-func md2s(content []byte, title []byte, style int, debug bool) (marpContent string) {
+// 変換結果に含める1ページ分の内容
+type ResultSlide struct {
+	Title   string   `json:"title"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+	Notes   []string `json:"notes,omitempty"`
+}
+
+func md2s(content []byte, title []byte, style int, debug bool) Result {
 	// マークダウンをページごとに変換
 	slides, err := parseMarkdown(content)
 	if err != nil {
 		log.Fatalf("[ERROR] Failed to parse Markdown: %v", err)
 	}
+	for _, warning := range parseWarnings {
+		fmt.Println("[WARN]", warning)
+	}
+	if dumpIntermediate != "" {
+		if err := writeOutput(dumpIntermediate, []byte(convertToIntermediate(slides))); err != nil {
+			log.Fatalf("[ERROR] Failed to write intermediate markdown: %v", err)
+		}
+		fmt.Println("Intermediate markdown saved to", dumpIntermediate)
+	}
+
+	// タイトルが空なら Gemini で生成する
+	if string(title) == "" && !debug {
+		fmt.Println("Title is empty. Generating title...")
+		title = generateTitle(content)
+	}
 
 	if !debug {
 		// Gemini で内容をスライドっぽくする
-		analyzedSlides, err := analyzeContentWithGemini(slides)
+		slides, err = analyzeContentWithGemini(slides)
 		if err != nil {
 			log.Fatalf("[ERROR] Failed to analyze content: %v", err)
 		}
+	}
 
-		// 連結＆marpタグ追加
-		marpContent = convertToMarp(analyzedSlides, title, style)
-	} else {
-		marpContent = convertToMarp(slides, title, style)
+	// 連結＆marpタグ追加（出力形式は -target で切り替え）
+	result := Result{
+		Title: strings.TrimSpace(string(title)),
+		Marp:  renderers[target].Render(slides, title, style),
+	}
+	if collapseBlankLines {
+		result.Marp = collapseBlankLineRuns(result.Marp)
+	}
+	for _, finalize := range finalizers {
+		result.Marp = finalize(result.Marp)
+	}
+	for _, slide := range slides {
+		texts, _ := slide.splitAtImages(slide.body())
+		var images []string
+		for _, image := range slide.Images {
+			images = append(images, image.Src)
+		}
+		result.Slides = append(result.Slides, ResultSlide{
+			Title:   slide.Title,
+			Content: strings.Join(texts, ""),
+			Images:  images,
+			Notes:   slide.Notes,
+		})
 	}
-	return marpContent
+	if separateNotes {
+		result.Notes = convertToNotes(slices.Concat(introSlides, orderSlides(slides), outroSlides))
+	}
+	return result
 }
 
 func generateTitle(content []byte) (title []byte) {
 	ctx := context.Background()
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("[ERROR] Error loading .env file")
-	}
+	loadEnv()
 
 	// Gemini APIクライアントを作成する
 	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
@@ -336,45 +2650,596 @@ func generateTitle(content []byte) (title []byte) {
 	defer client.Close()
 
 	// Gemini のモデル指定
-	model := client.GenerativeModel("gemini-1.5-flash")
+	model := client.GenerativeModel(geminiModel)
+	model.SafetySettings = safetySettings
 
 	// プロンプト設定するとこ
-	prompt := fmt.Sprintf("コンテンツをもとに短いタイトルを1つ作ってください。作ったタイトルだけ出力してください。コンテンツがない場合は何も出力しないでください。\n\n以下コンテンツ\n\n%s", string(content))
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	prompt := fmt.Sprintf("コンテンツをもとに短いタイトルを1つ作ってください。作ったタイトルだけ出力してください。コンテンツがない場合は何も出力しないでください。\n\n以下コンテンツ\n\n%s", titleSource(content, maxTitleSourceLength))
+	// スライドの要約と同じく、一時的なエラーは待ってから送り直し、時間の上限も合わせる
+	if slideTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, slideTimeout)
+		defer cancel()
+	}
+	text, err := generateText(ctx, model, prompt)
 	if err != nil {
-		fmt.Println("[ERROR] ", err)
+		fmt.Fprintln(os.Stderr, "[ERROR] failed to generate title; the deck is left untitled (pass -title to set one):", err)
 		return
 	}
+	title = []byte(text)
 
-	for _, part := range resp.Candidates[0].Content.Parts {
-		title = []byte(fmt.Sprintln(part))
+	return []byte(truncateTitle(unquoteTitle(string(title)), maxTitleLength))
+}
+
+// タイトルを囲む引用符やかぎ括弧の組
+var titleQuotes = [][2]string{{`"`, `"`}, {"'", "'"}, {"“", "”"}, {"‘", "’"}, {"「", "」"}, {"『", "』"}}
+
+// 外した引用符の中身が閉じていない引用を含まないか確認する関数
+func enclosesWhole(inner, open, close string) bool {
+	if open == close {
+		return !strings.Contains(inner, open)
+	}
+	depth := 0
+	for i := 0; i < len(inner); {
+		switch {
+		case strings.HasPrefix(inner[i:], open):
+			depth++
+			i += len(open)
+		case strings.HasPrefix(inner[i:], close):
+			depth--
+			if depth < 0 {
+				return false
+			}
+			i += len(close)
+		default:
+			i++
+		}
+	}
+	return depth == 0
+}
+
+// 生成したタイトル全体を囲む引用符やかぎ括弧を外す関数
+// 「A」と「B」のように途中で閉じている場合は全体を囲んでいないので外さない
+func unquoteTitle(title string) string {
+	title = strings.TrimSpace(title)
+	for {
+		unquoted := title
+		for _, q := range titleQuotes {
+			inner, ok := strings.CutPrefix(title, q[0])
+			if !ok || !strings.HasSuffix(inner, q[1]) {
+				continue
+			}
+			inner = strings.TrimSuffix(inner, q[1])
+			if !enclosesWhole(inner, q[0], q[1]) {
+				continue
+			}
+			unquoted = strings.TrimSpace(inner)
+			break
+		}
+		if unquoted == title {
+			return title
+		}
+		title = unquoted
+	}
+}
+
+// タイトル生成に渡す本文の最大文字数
+// 大きな文書でも入力上限を超えないよう、冒頭だけで判断させる
+const maxTitleSourceLength = 8000
+
+// 文字列を先頭から limit 文字（rune）までに切り詰める関数
+// バイト単位で切ると日本語などのマルチバイト文字が途中で壊れるので、必ず文字の境目で切る
+// 切り詰めた場合は true を返す
+func truncateRunes(s string, limit int) (string, bool) {
+	i := 0
+	for n := 0; n < limit; n++ {
+		if i >= len(s) {
+			return s, false
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
 	}
+	if i >= len(s) {
+		return s, false
+	}
+	return s[:i], true
+}
 
-	return title
+// タイトル生成用に本文の冒頭を切り出す関数
+// 行の途中で切れないよう、上限内の最後の改行までにする
+func titleSource(content []byte, limit int) string {
+	prefix, truncated := truncateRunes(string(content), limit)
+	if !truncated {
+		return prefix
+	}
+	if i := strings.LastIndex(prefix, "\n"); i > 0 {
+		prefix = prefix[:i]
+	}
+	return prefix
 }
 
-func main() {
-	content, err := os.ReadFile("example.md")
+// タイトルを最大文字数に収める関数
+// 単語の区切り（空白）があればそこで切り、末尾に省略記号を付ける
+var maxTitleLength = 0 // 0 なら制限なし
+func truncateTitle(title string, limit int) string {
+	if limit <= 0 || utf8.RuneCountInString(title) <= limit {
+		return title
+	}
+	cut, _ := truncateRunes(title, limit-1) // 省略記号の分を空ける
+	if i := strings.LastIndexAny(cut, " \t"); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimSpace(cut) + "…"
+}
+
+// URL から取得するマークダウンの上限サイズとタイムアウト
+const maxFetchSize = 5 << 20
+const fetchTimeout = 30 * time.Second
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// 入力を読み込む関数
+// http(s) の URL ならダウンロードし、それ以外はファイルとして読む
+// 先頭の BOM は最初の見出しの # にくっついて見出しとして読めなくなるので外す
+func readInput(input string) ([]byte, error) {
+	var content []byte
+	var err error
+	if isURL(input) {
+		content, err = fetchMarkdown(input)
+	} else {
+		content, err = os.ReadFile(input)
+	}
+	return stripBOM(content), err
+}
+
+// UTF-8 の BOM
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+func stripBOM(content []byte) []byte {
+	return bytes.TrimPrefix(content, utf8BOM)
+}
+
+// URL からマークダウンを取得する関数
+func fetchMarkdown(url string) ([]byte, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
 	if err != nil {
-		fmt.Println("[ERROR] failed to read markdown file: %w", err)
+		return nil, fmt.Errorf("failed to fetch %s: %w", url, err)
 	}
+	defer resp.Body.Close()
 
-	style := 3
-	title := []byte("")
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+	// HTML のページ（raw でない URL など）はマークダウンとして扱わない
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/html" {
+		return nil, fmt.Errorf("%s is not markdown (Content-Type: %s); use the raw file URL", url, mediaType)
+	}
 
-	if string(title) == "" {
-		fmt.Println("Title is empty. Generating title...")
-		title = generateTitle(content)
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", url, err)
+	}
+	if len(content) > maxFetchSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", url, maxFetchSize)
 	}
+	return content, nil
+}
 
-	result := md2s(content, []byte(title), style, false)
+// 既存の出力ファイルを上書きしないか（-no-clobber）
+var noClobber = false
 
-	// 変換結果をファイル出力
-	outputFile := strings.TrimSuffix("example", ".md") + "_marp.md"
-	err = os.WriteFile(outputFile, []byte(result), 0644)
+// 出力先がすでにある場合にエラーを返す関数
+// Gemini を呼ぶ前に確認して、無駄なリクエストを避ける
+func checkClobber(path string) error {
+	if !noClobber {
+		return nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists (use -force to overwrite)", path)
+	}
+	return nil
+}
+
+// 出力ファイルのパーミッション
+var outputMode os.FileMode = 0644
+
+// 出力ファイルを作る関数
+// -no-clobber のときは既存のファイルがあれば失敗する
+func createOutput(path string) (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if noClobber {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, outputMode)
+	if err != nil {
+		return nil, err
+	}
+	// 作成時は umask で削られ、既存のファイルは元のままなので明示的に設定する
+	if err := f.Chmod(outputMode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func writeOutput(path string, data []byte) error {
+	f, err := createOutput(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// 変換結果を1つの zip にまとめて書き出す関数
+func writeZip(zipPath string, names []string, results []string) error {
+	f, err := createOutput(zipPath)
 	if err != nil {
-		log.Fatalf("[ERROR] Failed to write Marp file: %v", err)
+		return fmt.Errorf("[ERROR] failed to create zip: %w", err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for i, name := range names {
+		w, err := zw.Create(filepath.Base(name))
+		if err != nil {
+			return fmt.Errorf("[ERROR] failed to add %s to zip: %w", name, err)
+		}
+		if _, err := w.Write([]byte(results[i])); err != nil {
+			return fmt.Errorf("[ERROR] failed to write %s to zip: %w", name, err)
+		}
+	}
+	return zw.Close()
+}
+
+func main() {
+	var stdoutJSON, countOnly, checkOnly, force, quiet, fromMarp, requireAI, skipPreflight bool
+	var zipPath, introPath, outroPath, slideRange, deckTitle, separator, combinePath string
+	flag.StringVar(&combinePath, "combine", "", "すべての入力を1つのデッキにまとめる（出力名のもとにするファイル名、例: deck.md）")
+	flag.BoolVar(&combineDividers, "dividers", false, "-combine のときファイルごとにファイル名の区切りのスライドを入れる")
+	flag.StringVar(&deckTitle, "title", "", "スライドのタイトル (空なら Gemini で生成)")
+	flag.BoolVar(&skipPreflight, "skip-preflight", false, "変換前の Gemini の接続確認を省く")
+	flag.BoolVar(&requireAI, "require-ai", false, "GEMINI_API_KEY がなければアウトライン出力にせずエラーで終了する")
+	flag.StringVar(&target, "target", "marp", "出力形式 (marp, reveal)")
+	flag.StringVar(&summaryStyle, "summary-style", "bullets", "要約スタイル (bullets, prose, concise, takeaway)")
+	flag.IntVar(&maxTitleLength, "max-title-length", 0, "生成するタイトルの最大文字数 (0 で制限なし)")
+	flag.IntVar(&maxBullets, "max-bullets", 0, "1スライドの箇条書きの最大数 (0 で制限なし)")
+	flag.StringVar(&containerDialect, "containers", "qiita", "::: のコンテナ記法の扱い (qiita, zenn, none)")
+	flag.IntVar(&bulletsPerSlide, "bullets", 0, "箇条書きをちょうどこの数にそろえる（0 なら指定しない、-max-bullets より優先）")
+	flag.BoolVar(&keepNesting, "keep-nesting", false, "最上位の箇条書きの項目ごとに要約して入れ子の構造を保つ")
+	flag.BoolVar(&headingContext, "heading-context", false, "見出しを要約プロンプトに文脈として含める")
+	flag.BoolVar(&force, "force", false, "既存の出力ファイルを上書きする (デフォルト)")
+	flag.StringVar(&dedupeTitles, "dedupe-titles", "", "同名の見出しを区別する (counter: 番号を付ける, parent: 親の見出しを付ける)")
+	mode := flag.String("mode", "0644", "出力ファイルのパーミッション（8進数、0600 や 0664 など）")
+	flag.BoolVar(&noClobber, "no-clobber", false, "既存の出力ファイルがあれば上書きせずに終了する")
+	flag.BoolVar(&quiet, "quiet", false, "エラー以外の出力を抑える")
+	flag.BoolVar(&fromMarp, "from-marp", false, "Marp のファイルを元のマークダウンに戻して <name>_source.md に出力する")
+	flag.BoolVar(&countOnly, "count", false, "Gemini を使わずにスライド数だけ表示する")
+	flag.BoolVar(&exactTokens, "exact-tokens", false, "トークン数を見積もらずに Gemini の CountTokens で数える（遅くなる）")
+	flag.BoolVar(&keepHardBreaks, "hard-breaks", false, "行末の2つ以上の空白による改行を残す（指定しなければ行末の空白をすべて消す）")
+	flag.BoolVar(&checkOnly, "check", false, "Gemini を使わずに変換できるかを確かめ、問題があれば終了コード 1 で終わる")
+	flag.BoolVar(&stdoutJSON, "stdout-json", false, "タイトル・スライド・Marp をまとめた JSON を標準出力に出す")
+	flag.StringVar(&zipPath, "zip", "", "変換結果をまとめて書き出す zip のパス")
+	flag.StringVar(&introPath, "intro", "", "冒頭に入れる固定スライドのマークダウン")
+	flag.StringVar(&outroPath, "outro", "", "末尾に入れる固定スライドのマークダウン")
+	flag.BoolVar(&keepCode, "keep-code", true, "コードブロックを要約せずそのまま残す")
+	flag.StringVar(&dumpIntermediate, "dump-intermediate", "", "要約前のスライドをマークダウンとしてこのファイルに書き出す（デバッグ用）")
+	flag.BoolVar(&sourceNotes, "source-notes", false, "要約前の本文を発表者ノートとして残す")
+	flag.BoolVar(&separateNotes, "notes-file", false, "発表者ノートを <name>_notes.md に分けて出力する")
+	flag.StringVar(&separator, "heading-separator", `\n\n`, "見出しと本文の間に入れる文字列 (\\n などのエスケープ可)")
+	flag.StringVar(&leadTemplate, "lead", "", "本文の最初の行を装飾するテンプレート (例: <p class=\"lead\">%s</p>)")
+	flag.StringVar(&markdownExtensions, "extensions", "gfm", "goldmark の拡張 (gfm, commonmark, または table,strikethrough,linkify,tasklist,subscript,superscript をカンマ区切り)")
+	flag.IntVar(&wideTableColumns, "table-scale-columns", 0, "この列数以上の表を含むスライドは表の文字を小さくする (0 で無効)")
+	flag.BoolVar(&collapseBlankLines, "collapse-blank-lines", true, "出力の3行以上続く空行を1行にまとめる")
+	flag.DurationVar(&slideTimeout, "slide-timeout", slideTimeout, "1枚のスライドの要約にかける時間の上限（再送の待ち時間を含む、0 なら制限なし）")
+	flag.IntVar(&maxRequests, "max-requests", 0, "Gemini に送るリクエスト数の上限（タイトル生成と再送を含む、0 なら制限なし）")
+	flag.IntVar(&tokensPerMinute, "tpm", 1000000, "Gemini の1分あたりの入力トークン数の上限 (推定トークン数でバッチを分ける)")
+	flag.IntVar(&requestsPerMinute, "rpm", 15, "Gemini の1分あたりのリクエスト数の上限 (送信ペースを自動で調整)")
+	flag.Var(levelClasses, "level-class", "見出しのレベルごとに付ける Marp のクラス (例: 1=lead、複数指定可)")
+	flag.Var(extraFrontMatter, "front-matter", "フロントマターに追加する Marp のディレクティブ (例: \"backgroundColor: black\"、複数指定可)")
+	flag.BoolVar(&pdfMode, "pdf", false, "Marp CLI で PDF に書き出す前提の出力にする（ページ番号、比率の固定、HTML を文字にする）")
+	flag.StringVar(&themeName, "theme-name", "", "組み込みのテーマの代わりに使う Marp のテーマ名 (CSS の /* @theme name */ と同じ名前)")
+	flag.StringVar(&themeCSS, "theme-css", "", "-theme-name のテーマの CSS (ファイルまたは URL、フロントマターの style に入れる)")
+	flag.StringVar(&slideSize, "size", "", "スライドの比率 (16:9, 4:3)")
+	flag.StringVar(&cacheDir, "cache", "", "要約結果をキャッシュするディレクトリ (途中で失敗しても再実行時に続きから処理する)")
+	flag.StringVar(&tagPlacement, "tags", "", "元の記事のタグを出す場所 (footer, title)")
+	flag.Var(&safetySettings, "safety", "安全フィルタのしきい値 (例: dangerous=none、複数指定可)")
+	flag.BoolVar(&useStream, "stream", false, "Gemini のストリーミング API で応答を受け取る")
+	formatOutput := flag.Bool("format", false, "出力の箇条書きの記号を - にそろえ、行末の空白を取り除く")
+	flag.Var(replaceFlag{}, "replace", "出力前に適用する正規表現の置換 (例: \"cdn.old.com=>cdn.new.com\"、複数指定可)")
+	flag.BoolVar(&cleanHeadings, "clean-headings", false, "見出しから {#anchor} のような属性の指定と先頭の番号を取り除く")
+	flag.StringVar(&tocMode, "toc", "", "タイトルの次に目次のスライドを入れる (list: 一覧のみ, links: ページへのリンク付き)")
+	flag.StringVar(&sectionName, "section", "", "この見出し（大文字小文字は区別しない）とその下の階層だけを変換する")
+	flag.BoolVar(&sourceLines, "source-lines", false, "各スライドに元のマークダウンの見出しの行番号を <!-- source: line N --> で入れる")
+	flag.IntVar(&timingWPM, "timing-wpm", 0, "1分あたりの単語数から各スライドの発表時間の目安を <!-- ~Ns --> で出す（0 なら出さない）")
+	flag.StringVar(&subtitle, "subtitle", "", "タイトルスライドのサブタイトル")
+	flag.StringVar(&author, "author", "", "タイトルスライドに出す発表者")
+	flag.StringVar(&date, "date", "", "タイトルスライドに出す日付")
+	flag.BoolVar(&imageCaptions, "captions", false, "画像の代替テキスト（または直後の *斜体* の段落）をキャプションとして画像の下に出す")
+	flag.StringVar(&backgroundMode, "background", "bg fit", "分離した画像の Marp の背景指定 (bg, bg fit, bg cover, bg contain, bg left, bg right)")
+	flag.StringVar(&slideRange, "range", "", "要約するスライドの範囲 (例: 5-10)")
+	flag.Parse()
+	// JSON やスライド数の出力時はログが混ざらないよう、ログを標準エラーに回す
+	stdout := os.Stdout
+	if stdoutJSON || countOnly || checkOnly {
+		os.Stdout = os.Stderr
+	}
+	// -quiet のときはエラー（標準エラー）以外のログを捨てる
+	if quiet {
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			log.Fatalf("[ERROR] failed to open %s: %v", os.DevNull, err)
+		}
+		os.Stdout = devNull
+	}
+	if _, ok := styles.SummaryStyleList[summaryStyle]; !ok {
+		log.Fatalf("[ERROR] unknown summary style: %s", summaryStyle)
+	}
+	if _, ok := renderers[target]; !ok {
+		log.Fatalf("[ERROR] unknown target: %s", target)
+	}
+	if _, err := buildExtensions(markdownExtensions); err != nil {
+		log.Fatal(err)
+	}
+
+	if slideSize != "" && !slices.Contains(supportedSizes, slideSize) {
+		log.Fatalf("[ERROR] unsupported size: %s (supported: %s)", slideSize, strings.Join(supportedSizes, ", "))
+	}
+	if tagPlacement != "" && tagPlacement != "footer" && tagPlacement != "title" {
+		log.Fatalf("[ERROR] unknown tags placement: %s", tagPlacement)
+	}
+	if !backgroundHintPattern.MatchString(backgroundMode) {
+		log.Fatalf("[ERROR] background must start with \"bg\": %s", backgroundMode)
+	}
+	if _, ok := containerDialects[containerDialect]; !ok && containerDialect != "none" {
+		log.Fatalf("[ERROR] unsupported containers: %s (qiita, zenn, none)", containerDialect)
+	}
+	if tocMode != "" && tocMode != "list" && tocMode != "links" {
+		log.Fatalf("[ERROR] unsupported toc: %s (list, links)", tocMode)
+	}
+	if dedupeTitles != "" && dedupeTitles != "counter" && dedupeTitles != "parent" {
+		log.Fatalf("[ERROR] unsupported dedupe-titles: %s (counter, parent)", dedupeTitles)
+	}
+	if m, err := strconv.ParseUint(*mode, 8, 32); err != nil || m > 0777 {
+		log.Fatalf("[ERROR] invalid mode: %s", *mode)
+	} else {
+		outputMode = os.FileMode(m)
+	}
+	if themeName != "" && !cssIdentifierPattern.MatchString(themeName) {
+		log.Fatalf("[ERROR] invalid theme name: %s (must be a CSS identifier)", themeName)
+	}
+	if themeCSS != "" {
+		if themeName == "" {
+			log.Fatal("[ERROR] -theme-css requires -theme-name")
+		}
+		style, err := loadThemeStyle(themeCSS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		themeStyle = style
+	}
+	if fromMarp && (stdoutJSON || countOnly || checkOnly) {
+		log.Fatal("[ERROR] -from-marp cannot be used with -stdout-json, -count or -check")
+	}
+	if *formatOutput {
+		AddFinalizer(formatMarkdown)
+	}
+	if force && noClobber {
+		log.Fatal("[ERROR] -force and -no-clobber cannot be used together")
+	}
+	if zipPath != "" {
+		if err := checkClobber(zipPath); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+	}
+
+	var err error
+	if headingSeparator, err = strconv.Unquote(`"` + separator + `"`); err != nil {
+		log.Fatalf("[ERROR] invalid heading separator: %v", err)
+	}
+	if leadTemplate != "" && strings.Count(leadTemplate, "%s") != 1 {
+		log.Fatalf("[ERROR] lead template must contain exactly one %%s: %s", leadTemplate)
+	}
+	if slideRange != "" {
+		if rangeStart, rangeEnd, err = parseSlideRange(slideRange); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if introPath != "" {
+		if introSlides, err = loadFixedSlides(introPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if outroPath != "" {
+		if outroSlides, err = loadFixedSlides(outroPath); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	fmt.Printf("[SUCCESS] Marp file generated: %s\n", outputFile)
+	// 入力ファイルの指定がなければ example.md を変換
+	inputFiles := flag.Args()
+	if len(inputFiles) == 0 {
+		inputFiles = []string{"example.md"}
+	}
+
+	// API キーがなければ要約せずに見出しと本文をそのまま並べたアウトラインを出力する
+	outline := false
+	if !countOnly && !checkOnly && !fromMarp {
+		loadEnv()
+		if os.Getenv("GEMINI_API_KEY") == "" {
+			if requireAI {
+				log.Fatal("[ERROR] GEMINI_API_KEY is not set (required by -require-ai)")
+			}
+			// -quiet でも見えるよう標準エラーに出す
+			fmt.Fprintln(os.Stderr, "[WARN] ==================================================")
+			fmt.Fprintln(os.Stderr, "[WARN] GEMINI_API_KEY is not set. Falling back to outline mode (no AI summaries).")
+			fmt.Fprintln(os.Stderr, "[WARN] Set GEMINI_API_KEY in .env or pass -require-ai to make this an error.")
+			fmt.Fprintln(os.Stderr, "[WARN] ==================================================")
+			outline = true
+		} else if !skipPreflight {
+			// 時間のかかる変換の途中で API キーやネットワークの問題に気付かないよう先に確認する
+			if err := preflightGemini(context.Background()); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// -combine のときはすべての入力をつなげて1回だけ変換する（Gemini のペース配分も全体で行う）
+	var combined []byte
+	if combinePath != "" {
+		var contents [][]byte
+		for _, inputFile := range inputFiles {
+			content, err := readInput(inputFile)
+			if err != nil {
+				log.Fatalf("[ERROR] failed to read markdown file: %v", err)
+			}
+			contents = append(contents, content)
+		}
+		combined = combineMarkdown(inputFiles, contents)
+		inputFiles = []string{combinePath}
+	}
+
+	style := 3
+	failedChecks := 0
+	var outputFiles []string
+	var results []string
+	var jsonResults []Result
+	for _, inputFile := range inputFiles {
+		content := combined
+		if content == nil {
+			var err error
+			content, err = readInput(inputFile)
+			if err != nil {
+				log.Fatalf("[ERROR] failed to read markdown file: %v", err)
+			}
+		}
+		if isURL(inputFile) {
+			// URL の場合は末尾のファイル名をもとにカレントディレクトリへ出力
+			inputFile = path.Base(strings.TrimSuffix(inputFile, "/"))
+		}
+
+		if fromMarp {
+			// Marp のファイルを元のマークダウンに戻して <name>_source.md に出力
+			source, err := MarpToMarkdown(string(content))
+			if err != nil {
+				log.Fatalf("[ERROR] Failed to convert Marp: %v", err)
+			}
+			outputFile := strings.TrimSuffix(strings.TrimSuffix(inputFile, ".md"), "_marp") + "_source.md"
+			if err := checkClobber(outputFile); err != nil {
+				log.Fatalf("[ERROR] %v", err)
+			}
+			outputFiles = append(outputFiles, outputFile)
+			results = append(results, source)
+			continue
+		}
+
+		if countOnly {
+			count, err := CountSlides(content, currentOptions())
+			if err != nil {
+				log.Fatalf("[ERROR] Failed to parse Markdown: %v", err)
+			}
+			fmt.Fprintf(stdout, "%s: %d\n", inputFile, count)
+			continue
+		}
+
+		if checkOnly {
+			count, problems, err := CheckMarkdown(content)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[ERROR] %s: %v\n", inputFile, err)
+				failedChecks++
+				continue
+			}
+			fmt.Fprintf(stdout, "%s: %d slides\n", inputFile, count)
+			for _, problem := range problems {
+				fmt.Fprintf(os.Stderr, "[ERROR] %s: %s\n", inputFile, problem)
+			}
+			if len(problems) > 0 {
+				failedChecks++
+			}
+			continue
+		}
+
+		// 上書きしない設定なら変換前に出力先を確認する
+		if zipPath == "" && !stdoutJSON {
+			base := strings.TrimSuffix(inputFile, ".md")
+			if err := checkClobber(base + renderers[target].Suffix()); err != nil {
+				log.Fatalf("[ERROR] %v", err)
+			}
+			if separateNotes {
+				if err := checkClobber(base + "_notes.md"); err != nil {
+					log.Fatalf("[ERROR] %v", err)
+				}
+			}
+		}
+
+		title := deckTitle
+		if outline && title == "" {
+			// タイトルも生成できないのでファイル名を使う
+			title = strings.TrimSuffix(path.Base(inputFile), ".md")
+		}
+		result := md2s(content, []byte(title), style, outline)
+		if stdoutJSON {
+			jsonResults = append(jsonResults, result)
+			continue
+		}
+
+		outputFiles = append(outputFiles, strings.TrimSuffix(inputFile, ".md")+renderers[target].Suffix())
+		results = append(results, result.Marp)
+		if separateNotes {
+			outputFiles = append(outputFiles, strings.TrimSuffix(inputFile, ".md")+"_notes.md")
+			results = append(results, result.Notes)
+		}
+	}
+
+	if countOnly {
+		return
+	}
+	if checkOnly {
+		if failedChecks > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// JSON 指定があれば標準出力にまとめて出力
+	if stdoutJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		var err error
+		if len(jsonResults) == 1 {
+			err = encoder.Encode(jsonResults[0])
+		} else {
+			err = encoder.Encode(jsonResults)
+		}
+		if err != nil {
+			log.Fatalf("[ERROR] Failed to write JSON: %v", err)
+		}
+		return
+	}
+
+	// zip 指定があればまとめて出力
+	if zipPath != "" {
+		if err := writeZip(zipPath, outputFiles, results); err != nil {
+			log.Fatalf("[ERROR] Failed to write zip file: %v", err)
+		}
+		fmt.Printf("[SUCCESS] Marp files archived: %s\n", zipPath)
+		return
+	}
+
+	// 変換結果をファイル出力
+	for i, outputFile := range outputFiles {
+		err := writeOutput(outputFile, []byte(results[i]))
+		if err != nil {
+			log.Fatalf("[ERROR] Failed to write Marp file: %v", err)
+		}
+
+		fmt.Printf("[SUCCESS] Marp file generated: %s\n", outputFile)
+	}
 }
@@ -0,0 +1,1822 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"md2MarpAPI/styles"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+)
+
+// main を別プロセスで動かすときの引数（JSON の配列）を渡す環境変数
+const mainArgsEnv = "MD2S_TEST_MAIN_ARGS"
+
+// 別プロセスの Gemini の代わりに返す応答（空なら Gemini に送ろうとした時点で失敗させる）
+const mainReplyEnv = "MD2S_TEST_MAIN_REPLY"
+
+// 別プロセスで要約を「- summarized」に差し替えて変換させるときの環境変数
+var summarizedEnv = []string{"GEMINI_API_KEY=test-key", mainReplyEnv + "=- summarized"}
+
+func TestMain(m *testing.M) {
+	if encoded := os.Getenv(mainArgsEnv); encoded != "" {
+		var args []string
+		if err := json.Unmarshal([]byte(encoded), &args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		os.Args = append([]string{"md2s"}, args...)
+		reply := os.Getenv(mainReplyEnv)
+		generateContent = func(ctx context.Context, model *genai.GenerativeModel, prompt string) (*genai.GenerateContentResponse, error) {
+			if reply != "" {
+				return textResponse(reply), nil
+			}
+			fmt.Fprintln(os.Stderr, "[TEST] unexpected Gemini request")
+			os.Exit(3)
+			return nil, nil
+		}
+		// 応答がない場合、事前確認は認証に失敗したものとして扱う
+		countTokens = func(ctx context.Context, model *genai.GenerativeModel, text string) (*genai.CountTokensResponse, error) {
+			if reply != "" {
+				return &genai.CountTokensResponse{TotalTokens: 1}, nil
+			}
+			return nil, fmt.Errorf("[TEST] API key not valid")
+		}
+		generateContentStream = func(ctx context.Context, model *genai.GenerativeModel, prompt string) contentIterator {
+			fmt.Fprintln(os.Stderr, "[TEST] unexpected Gemini request")
+			os.Exit(3)
+			return nil
+		}
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// dir をカレントディレクトリにして main を別プロセスで動かし、標準出力・標準エラー・終了コードを返す
+// GEMINI_API_KEY は引き継がず、必要なら env で渡す
+func runMain(t *testing.T, dir string, env []string, args ...string) (string, string, int) {
+	t.Helper()
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(executable, "-test.run=^$")
+	cmd.Dir = dir
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "GEMINI_API_KEY=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Env = append(cmd.Env, mainArgsEnv+"="+string(encoded))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	code := 0
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatal(err)
+		}
+		code = exitErr.ExitCode()
+	}
+	return stdout.String(), stderr.String(), code
+}
+
+// ファイルを書き込む（失敗したらテストを止める）
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// テスト中だけグローバルな設定を変え、終わったら元に戻す
+func setGlobal[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// マークダウンをスライドに分ける（失敗したらテストを止める）
+func parse(t *testing.T, md string) []*Slide {
+	t.Helper()
+	slides, err := parseMarkdown([]byte(md))
+	if err != nil {
+		t.Fatalf("parseMarkdown: %v", err)
+	}
+	return slides
+}
+
+// テキストだけの Gemini の応答を作る
+func textResponse(text string) *genai.GenerateContentResponse {
+	return &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{Content: &genai.Content{Parts: []genai.Part{genai.Text(text)}}}},
+	}
+}
+
+// Gemini の代わりに応答を返し、送られたプロンプトを記録する
+type geminiStub struct {
+	mu      sync.Mutex
+	prompts []string
+}
+
+func (s *geminiStub) calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.prompts...)
+}
+
+func stubGemini(t *testing.T, reply func(prompt string) (string, error)) *geminiStub {
+	t.Helper()
+	t.Setenv("GEMINI_API_KEY", "test-key")
+	stub := &geminiStub{}
+	setGlobal(t, &generateContent, func(ctx context.Context, model *genai.GenerativeModel, prompt string) (*genai.GenerateContentResponse, error) {
+		stub.mu.Lock()
+		stub.prompts = append(stub.prompts, prompt)
+		stub.mu.Unlock()
+		text, err := reply(prompt)
+		if err != nil {
+			return nil, err
+		}
+		return textResponse(text), nil
+	})
+	return stub
+}
+
+// 常に同じ要約を返す
+func replyWith(text string) func(string) (string, error) {
+	return func(string) (string, error) { return text, nil }
+}
+
+func TestInlineImageStaysInline(t *testing.T) {
+	slides := parse(t, "# Setup\n\nClick the ![gear](gear.png) icon to open settings.\n\n![](diagram.png)\n")
+	if len(slides) != 1 {
+		t.Fatalf("got %d slides, want 1", len(slides))
+	}
+	slide := slides[0]
+	if !strings.Contains(slide.Content, "![gear](gear.png)") {
+		t.Errorf("inline image was not kept in place: %q", slide.Content)
+	}
+	if len(slide.Images) != 1 || slide.Images[0].Src != "diagram.png" {
+		t.Errorf("only the standalone image should become a background, got %+v", slide.Images)
+	}
+	marp := convertToMarp(slides, []byte("Deck"), 0)
+	if strings.Contains(marp, "![bg fit](gear.png)") {
+		t.Errorf("inline image was rendered as a background:\n%s", marp)
+	}
+	if !strings.Contains(marp, "![bg fit](diagram.png)") {
+		t.Errorf("block image was not rendered as a background:\n%s", marp)
+	}
+}
+
+func TestMathBlockIsKeptVerbatim(t *testing.T) {
+	stub := stubGemini(t, replyWith("- summarized"))
+	slides := parse(t, "# Energy\n\nMass and energy are related.\n\n$$E=mc^2$$\n")
+	slides, err := analyzeContentWithGemini(slides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prompt := range stub.calls() {
+		if strings.Contains(prompt, "E=mc^2") {
+			t.Errorf("math was sent to Gemini: %q", prompt)
+		}
+	}
+	marp := convertToMarp(slides, []byte("Deck"), 0)
+	if !strings.Contains(marp, "$$E=mc^2$$") {
+		t.Errorf("math block was changed:\n%s", marp)
+	}
+}
+
+func TestMathBlockStaysInPlace(t *testing.T) {
+	slides := parse(t, "# Energy\n\nbefore\n\n$$E=mc^2$$\n\nafter\n")
+	if strings.Contains(slides[0].Content, "E=mc^2") {
+		t.Errorf("math was not replaced with a placeholder: %q", slides[0].Content)
+	}
+	body := slides[0].body()
+	before, math, after := strings.Index(body, "before"), strings.Index(body, "$$E=mc^2$$"), strings.Index(body, "after")
+	if math < 0 || !(before < math && math < after) {
+		t.Errorf("math block moved:\n%s", body)
+	}
+	// 要約でプレースホルダーが消えても数式は残す
+	slides[0].Content = "- summarized\n"
+	if body := slides[0].body(); strings.Count(body, "$$E=mc^2$$") != 1 {
+		t.Errorf("math block was lost after summary:\n%s", body)
+	}
+}
+
+func TestDollarsInCodeAreNotMath(t *testing.T) {
+	slides := parse(t, "# A\n\n```sh\necho $$\n```\n\n# B\n\nRun `kill $$` or:\n\n    kill $$\n")
+	if len(slides) != 2 || slides[1].Title != "B" {
+		t.Fatalf("heading between the code blocks was lost: %+v", slides)
+	}
+	if len(mathList) != 0 {
+		t.Errorf("code was taken as math: %q", mathList)
+	}
+	if body := slides[0].body(); !strings.Contains(body, "echo $$\n") {
+		t.Errorf("code block was changed: %q", body)
+	}
+	if body := slides[1].body(); !strings.Contains(body, "`kill $$`") || !strings.Contains(body, "```\nkill $$\n```") {
+		t.Errorf("code was changed: %q", body)
+	}
+}
+
+func TestDisplayMathDoesNotCrossBlankLinesOrHeadings(t *testing.T) {
+	slides := parse(t, "# A\n\nIt costs $$5\n\n# B\n\nor $$6 $$\n# C\n\ntext\n")
+	if len(slides) != 3 {
+		t.Fatalf("got %d slides, want 3: %+v", len(slides), slides)
+	}
+	if len(mathList) != 1 || mathList[0] != "$$6 $$" {
+		t.Errorf("math = %q, want only the one on a single line", mathList)
+	}
+}
+
+func TestSummaryStyleSelectsPrompt(t *testing.T) {
+	setGlobal(t, &summaryStyle, "prose")
+	stub := stubGemini(t, replyWith("A short paragraph."))
+	if _, err := analyzeContentWithGemini(parse(t, "# A\n\nSome text to summarize.\n")); err != nil {
+		t.Fatal(err)
+	}
+	calls := stub.calls()
+	if len(calls) != 1 {
+		t.Fatalf("got %d requests, want 1", len(calls))
+	}
+	if !strings.Contains(calls[0], styles.SummaryStyleList["prose"]) {
+		t.Errorf("prose template was not used: %q", calls[0])
+	}
+	if strings.Contains(calls[0], styles.SummaryStyleList["bullets"]) {
+		t.Errorf("bullets template was used: %q", calls[0])
+	}
+}
+
+func TestDotenvIsLoadedOnce(t *testing.T) {
+	stubGemini(t, replyWith("- summarized"))
+	setGlobal(t, &loadEnvOnce, sync.Once{})
+	loads := 0
+	setGlobal(t, &loadDotenv, func(filenames ...string) error {
+		loads++
+		return nil
+	})
+	// タイトルの生成と要約の両方で Gemini を使う変換
+	result := md2s([]byte("# A\n\nbody\n\n# B\n\nmore\n"), nil, 0, false)
+	if !strings.Contains(result.Marp, "- summarized") {
+		t.Fatalf("conversion did not use the summaries:\n%s", result.Marp)
+	}
+	if loads != 1 {
+		t.Errorf(".env was read %d times, want 1", loads)
+	}
+}
+
+func TestGeneratedTitleIsTruncatedOnWordBoundary(t *testing.T) {
+	const generated = "An Extremely Long Generated Title About Many Things"
+	stubGemini(t, replyWith(generated))
+	setGlobal(t, &maxTitleLength, 20)
+	title := string(generateTitle([]byte("# A\n\nbody\n")))
+	if utf8.RuneCountInString(title) > 20 {
+		t.Errorf("title %q is longer than 20 characters", title)
+	}
+	kept, ok := strings.CutSuffix(title, "…")
+	if !ok || !strings.HasPrefix(generated, kept+" ") {
+		t.Errorf("title %q was not cut on a word boundary with an ellipsis", title)
+	}
+}
+
+func TestZipContainsEveryInput(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.md"), "# A\n\nfirst\n")
+	writeFile(t, filepath.Join(dir, "b.md"), "# B\n\nsecond\n")
+	_, stderr, code := runMain(t, dir, summarizedEnv, "-zip", "out.zip", "a.md", "b.md")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	archive, err := zip.OpenReader(filepath.Join(dir, "out.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	var names []string
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "a_marp.md,b_marp.md" {
+		t.Errorf("zip entries = %q, want a_marp.md and b_marp.md", names)
+	}
+}
+
+func TestImagePathWithSpaceIsEncoded(t *testing.T) {
+	marp := convertToMarp(parse(t, "# A\n\n![](<my image.png>)\n\nSee ![icon](<icons/my icon.png>) here.\n"), []byte("Deck"), 0)
+	if !strings.Contains(marp, "![bg fit](my%20image.png)") {
+		t.Errorf("background image directive is broken:\n%s", marp)
+	}
+	if !strings.Contains(marp, "![icon](icons/my%20icon.png)") {
+		t.Errorf("inline image is broken:\n%s", marp)
+	}
+}
+
+func TestOutroSlideComesLast(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outro.md")
+	writeFile(t, path, "# Thank you\n\nQuestions?\n")
+	outro, err := loadFixedSlides(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &outroSlides, outro)
+	marp := convertToMarp(parse(t, "# A\n\nfirst\n\n# B\n\nsecond\n"), []byte("Deck"), 0)
+	pages := strings.Split(marp, "\n---\n")
+	if last := pages[len(pages)-1]; !strings.Contains(last, "# Thank you") || !strings.Contains(last, "Questions?") {
+		t.Errorf("last page is not the outro: %q", last)
+	}
+}
+
+func TestEveryListItemIsKept(t *testing.T) {
+	slides := parse(t, "# List\n\n- first item\n- second item\n- third item\n")
+	content := strings.Join(strings.Fields(slides[0].Content), " ")
+	for _, item := range []string{"- first item", "- second item", "- third item"} {
+		if !strings.Contains(content, item) {
+			t.Errorf("%q is missing from %q", item, slides[0].Content)
+		}
+	}
+}
+
+func TestLinkInParagraphAppearsOnce(t *testing.T) {
+	slides := parse(t, "# A\n\nRead the [guide](https://example.com/guide) before starting.\n")
+	content := slides[0].Content
+	if n := strings.Count(content, "[guide](https://example.com/guide)"); n != 1 {
+		t.Errorf("link appears %d times in %q", n, content)
+	}
+	if n := strings.Count(content, "guide"); n != 2 {
+		t.Errorf("link text was duplicated: %q", content)
+	}
+}
+
+func TestHeadingContextIsSentInPrompt(t *testing.T) {
+	setGlobal(t, &headingContext, true)
+	stub := stubGemini(t, replyWith("- summarized"))
+	slides, err := analyzeContentWithGemini(parse(t, "# Garbage Collection Tuning\n\nSome details.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := stub.calls()
+	if len(calls) != 1 || !strings.Contains(calls[0], "Garbage Collection Tuning") {
+		t.Errorf("heading was not part of the prompt: %q", calls)
+	}
+	if strings.Contains(slides[0].Content, "Garbage Collection Tuning") {
+		t.Errorf("heading leaked into the body: %q", slides[0].Content)
+	}
+}
+
+// 行頭が箇条書きの記号の行を数える
+func countBullets(content string) int {
+	n := 0
+	for _, line := range strings.Split(content, "\n") {
+		if bulletPattern.MatchString(line) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestExcessBulletsAreTrimmed(t *testing.T) {
+	setGlobal(t, &maxBullets, 5)
+	stub := stubGemini(t, replyWith("- one\n- two\n- three\n- four\n- five\n- six\n- seven\n- eight"))
+	slides, err := analyzeContentWithGemini(parse(t, "# A\n\nA long text.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := stub.calls(); len(calls) != 1 || !strings.Contains(calls[0], "最大5個") {
+		t.Errorf("prompt did not ask for at most 5 bullets: %q", calls)
+	}
+	if n := countBullets(slides[0].Content); n != 5 {
+		t.Errorf("got %d bullets, want 5: %q", n, slides[0].Content)
+	}
+	if strings.Contains(slides[0].Content, "six") {
+		t.Errorf("the sixth bullet was kept: %q", slides[0].Content)
+	}
+}
+
+// 見出しと本文だけのスライドが n 枚ある文書を作る
+func numberedSlides(n int) string {
+	var md strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&md, "# Slide %d\n\nbody of slide %d.\n\n", i, i)
+	}
+	return md.String()
+}
+
+func TestRangeSummarizesOnlySelectedSlides(t *testing.T) {
+	setGlobal(t, &rangeStart, 3)
+	setGlobal(t, &rangeEnd, 4)
+	stub := stubGemini(t, replyWith("- summarized"))
+	slides, err := analyzeContentWithGemini(parse(t, numberedSlides(10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := stub.calls(); len(calls) != 2 {
+		t.Fatalf("got %d requests, want 2", len(calls))
+	}
+	for i, slide := range slides {
+		summarized := strings.Contains(slide.Content, "- summarized")
+		if want := i == 2 || i == 3; summarized != want {
+			t.Errorf("slide %d summarized = %v, want %v", i+1, summarized, want)
+		}
+	}
+}
+
+// Marp がページ区切りとして扱う行（コードブロックの外の区切り線）を数える
+func countSeparators(marp string) int {
+	n := 0
+	inFence := false
+	for _, line := range strings.Split(marp, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if !inFence && separatorPattern.MatchString(line) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSeparatorsInContentDoNotBreakPages(t *testing.T) {
+	stubGemini(t, replyWith("- before\n---\n- middle\n***\n- after\n_ _ _"))
+	slides, err := analyzeContentWithGemini(parse(t, "# A\n\nfirst\n\n# B\n\n```\n---\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 要約していないスライドの本文の区切り線も崩す
+	slides = append(slides, &Slide{Title: "C", Content: "line\n- - -\nline\n", Failed: true})
+	marp := convertToMarp(slides, []byte("Deck"), 0)
+	// フロントマターの2本と、3枚のスライドの前に1本ずつ
+	if n := countSeparators(marp); n != 5 {
+		t.Errorf("got %d page separators, want 5:\n%s", n, marp)
+	}
+	if !strings.Contains(marp, "```\n---\n```") {
+		t.Errorf("--- inside a code block was changed:\n%s", marp)
+	}
+}
+
+// ベンチマーク用の文書（見出し・段落・リスト・表・引用・コード・画像を n セクション分）
+func benchmarkFixture(n int) []byte {
+	var md strings.Builder
+	md.WriteString("---\ntitle: Benchmark\ntags: [go, marp]\n---\n\nAn abstract before the first heading.\n\n")
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&md, "# Section %d\n\n", i)
+		fmt.Fprintf(&md, "Paragraph %d with **bold**, `code`, a [link](https://example.com/%d) and math $x_%d$.\n\n", i, i, i)
+		md.WriteString("- item one\n- item two\n  - nested item\n1. first\n2. second\n\n")
+		md.WriteString("| a | b | c |\n|---|---|---|\n| 1 | 2 | 3 |\n\n")
+		md.WriteString("> quoted text\n> over two lines\n\n")
+		md.WriteString("```go\nfunc main() {\n\tfmt.Println(\"hi\")\n}\n```\n\n")
+		fmt.Fprintf(&md, "![diagram](images/%d.png)\n\n## Details %d\n\nMore text.\n\n", i, i)
+	}
+	return []byte(md.String())
+}
+
+var benchmarkSizes = []struct {
+	name     string
+	sections int
+}{
+	{"small", 5},
+	{"medium", 50},
+	{"large", 500},
+}
+
+func BenchmarkParseMarkdown(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		content := benchmarkFixture(size.sections)
+		b.Run(size.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				if _, err := parseMarkdown(content); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkConvertToMarp(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		slides, err := parseMarkdown(benchmarkFixture(size.sections))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(size.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				convertToMarp(slides, []byte("Benchmark"), 0)
+			}
+		})
+	}
+}
+
+func TestNotesFileKeepsNotesOutOfMarp(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "talk.md"), "# A\n\nbody\n\n<!-- remember to demo -->\n")
+	_, stderr, code := runMain(t, dir, summarizedEnv, "-notes-file", "talk.md")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	notes, err := os.ReadFile(filepath.Join(dir, "talk_notes.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(notes), "## 1. A") || !strings.Contains(string(notes), "remember to demo") {
+		t.Errorf("note is missing from the notes file:\n%s", notes)
+	}
+	marp, err := os.ReadFile(filepath.Join(dir, "talk_marp.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(marp), "remember to demo") {
+		t.Errorf("note is still in the Marp output:\n%s", marp)
+	}
+}
+
+func TestCodeBlockIsByteIdenticalAfterSummary(t *testing.T) {
+	const code = "```python\ndef greet(name):\n    if name:\n        return f\"hi {name}\"  \n\treturn None\n```"
+	stub := stubGemini(t, replyWith("- explains {{CODE0}} briefly"))
+	slides, err := analyzeContentWithGemini(parse(t, "# Code\n\nThis function greets.\n\n"+code+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := stub.calls(); len(calls) != 1 || strings.Contains(calls[0], "def greet") {
+		t.Errorf("code was sent to Gemini: %q", calls)
+	}
+	if body := slides[0].body(); !strings.Contains(body, code) {
+		t.Errorf("code block changed:\n%s", body)
+	}
+}
+
+func TestHugeSlideIsSplitIntoRequests(t *testing.T) {
+	setGlobal(t, &maxSlideTokens, 200)
+	stub := stubGemini(t, replyWith("- part"))
+	huge := strings.Repeat("This sentence is part of an artificially huge slide.\n", 200)
+	slides, err := analyzeContentWithGemini(parse(t, "# Huge\n\n"+huge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(stub.calls()); n < 2 {
+		t.Errorf("got %d requests, want the slide split into several", n)
+	}
+	for _, prompt := range stub.calls() {
+		if tokens := heuristicTokens(prompt); tokens > 200+heuristicTokens(buildSummaryPrompt(&Slide{})) {
+			t.Errorf("a request has %d tokens, over the limit", tokens)
+		}
+	}
+	if slides[0].Failed || !strings.Contains(slides[0].Content, "- part") {
+		t.Errorf("huge slide was not summarized: %+v", slides[0])
+	}
+}
+
+func TestProvidedTitleSkipsTitleGeneration(t *testing.T) {
+	stub := stubGemini(t, replyWith("- summarized"))
+	result := md2s([]byte("# A\n\nbody\n"), []byte("My Own Deck"), 0, false)
+	for _, prompt := range stub.calls() {
+		if strings.Contains(prompt, "タイトルを1つ作って") {
+			t.Errorf("title was generated although one was provided")
+		}
+	}
+	if !strings.Contains(result.Marp, "# My Own Deck\n") || result.Title != "My Own Deck" {
+		t.Errorf("provided title is not used: %q\n%s", result.Title, result.Marp)
+	}
+}
+
+func TestUnterminatedFenceIsWarned(t *testing.T) {
+	slides := parse(t, "# Setup\n\n```sh\nmake install\n\n# Usage\n\nrun it\n")
+	if len(slides) != 1 {
+		t.Errorf("got %d slides, want the rest merged into the code block", len(slides))
+	}
+	if len(parseWarnings) != 1 || !strings.Contains(parseWarnings[0], "unterminated") {
+		t.Errorf("warnings = %q, want one about the unterminated fence", parseWarnings)
+	}
+	parse(t, "# Setup\n\n```sh\n# a comment\nmake install\n```\n")
+	if len(parseWarnings) != 0 {
+		t.Errorf("a closed fence was warned about: %q", parseWarnings)
+	}
+}
+
+func TestRevealUsesVerticalSlidesForImages(t *testing.T) {
+	slides := parse(t, "# A\n\nbefore\n\n![](chart.png)\n\nafter\n\n# B\n\nnext\n")
+	out := RevealRenderer{}.Render(slides, []byte("Deck"), 0)
+	if !strings.Contains(out, "\n--\n\n![](chart.png)\n") {
+		t.Errorf("image is not a vertical sub-slide:\n%s", out)
+	}
+	if !regexp.MustCompile(`\n--\n\s*after`).MatchString(out) {
+		t.Errorf("text after the image is not a vertical sub-slide:\n%s", out)
+	}
+	if !strings.Contains(out, "\n---\n\n## B") {
+		t.Errorf("next slide is not a horizontal slide:\n%s", out)
+	}
+}
+
+func TestImageIsEmittedOnceAcrossBatches(t *testing.T) {
+	setGlobal(t, &batchDelay, 0)
+	stub := stubGemini(t, replyWith("- summarized"))
+	md := numberedSlides(30) + "# With image\n\ntext\n\n![](only.png)\n"
+	slides, err := analyzeContentWithGemini(parse(t, md))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batches := splitBatches(slides, newPacing(requestsPerMinute, tokensPerMinute)); len(batches) < 2 {
+		t.Fatalf("got %d batches, want several", len(batches))
+	}
+	if n := len(stub.calls()); n != 31 {
+		t.Errorf("got %d requests, want 31", n)
+	}
+	if n := strings.Count(convertToMarp(slides, []byte("Deck"), 0), "(only.png)"); n != 1 {
+		t.Errorf("image appears %d times, want 1", n)
+	}
+}
+
+func TestLeadTemplateWrapsFirstLine(t *testing.T) {
+	setGlobal(t, &leadTemplate, `<p class="lead" style="width:100%">%s</p>`)
+	slides := parse(t, "# A\n\n```\ncode first\n```\n\nOverview\n\nAfterword\n")
+	marp := convertToMarp(slides, []byte("Deck"), 0)
+	if !strings.Contains(marp, `<p class="lead" style="width:100%">Overview</p>`) {
+		t.Errorf("first line is not wrapped:\n%s", marp)
+	}
+	if strings.Contains(marp, "%!") || strings.Contains(marp, `lead" style="width:100%">Afterword`) {
+		t.Errorf("template was applied wrongly:\n%s", marp)
+	}
+}
+
+func TestFencedCodeKeepsIndentation(t *testing.T) {
+	const code = "```python\nclass A:\n    def f(self):\n        if True:\n\n            return 1\n```\n"
+	marp := convertToMarp(parse(t, "# Code\n\n"+code+"\nafter\n"), []byte("Deck"), 0)
+	if !strings.Contains(marp, "\n"+code) {
+		t.Errorf("code block was not preserved exactly:\n%s", marp)
+	}
+}
+
+func TestCommonMarkKeepsTildesLiteral(t *testing.T) {
+	setGlobal(t, &markdownExtensions, "commonmark")
+	slides := parse(t, "# A\n\nuse ~~old~~ value\n")
+	if !strings.Contains(slides[0].Content, "use ~~old~~ value") {
+		t.Errorf("tildes were not kept literally: %q", slides[0].Content)
+	}
+}
+
+func TestGeneratedTitleIsReturned(t *testing.T) {
+	stubGemini(t, func(prompt string) (string, error) {
+		if strings.Contains(prompt, "タイトルを1つ作って") {
+			return "Generated Deck", nil
+		}
+		return "- summarized", nil
+	})
+	result := md2s([]byte("# A\n\nbody\n"), nil, 0, false)
+	if result.Title != "Generated Deck" {
+		t.Errorf("Title = %q, want the generated title", result.Title)
+	}
+	if !strings.Contains(result.Marp, "# "+result.Title+"\n") {
+		t.Errorf("returned title does not match the deck:\n%s", result.Marp)
+	}
+}
+
+func TestWideTableIsScaled(t *testing.T) {
+	setGlobal(t, &wideTableColumns, 6)
+	md := "# Wide\n\n| a | b | c | d | e | f |\n|---|---|---|---|---|---|\n| 1 | 2 | 3 | 4 | 5 | 6 |\n\n# Narrow\n\n| a | b |\n|---|---|\n| 1 | 2 |\n"
+	marp := convertToMarp(parse(t, md), []byte("Deck"), 0)
+	if n := strings.Count(marp, "<style scoped>table{font-size:60%}</style>"); n != 1 {
+		t.Errorf("got %d scaled tables, want only the wide one:\n%s", n, marp)
+	}
+	if wide := strings.Index(marp, "# Wide"); !strings.Contains(marp[wide:strings.Index(marp, "# Narrow")], "table{font-size:60%}") {
+		t.Errorf("style is not on the wide table's slide:\n%s", marp)
+	}
+	// スタイルが効くよう、表は表の記法のまま出力する
+	if !strings.Contains(marp, "| a | b | c | d | e | f |\n|---|---|---|---|---|---|\n| 1 | 2 | 3 | 4 | 5 | 6 |\n") {
+		t.Errorf("wide table is not rendered as a table:\n%s", marp)
+	}
+	if !strings.Contains(marp, "| a | b |\n|---|---|\n| 1 | 2 |\n") {
+		t.Errorf("narrow table is not rendered as a table:\n%s", marp)
+	}
+}
+
+func TestStdoutJSONHasTitleSlidesAndMarp(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "talk.md"), "# A\n\nbody\n")
+	stdout, stderr, code := runMain(t, dir, summarizedEnv, "-stdout-json", "-title", "Deck", "talk.md")
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, stderr)
+	}
+	var got map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+		t.Fatalf("stdout is not JSON: %v\n%s", err, stdout)
+	}
+	for _, key := range []string{"title", "slides", "marp"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("key %q is missing:\n%s", key, stdout)
+		}
+	}
+}
+
+func TestImageKeepsItsPlaceBetweenParagraphs(t *testing.T) {
+	marp := convertToMarp(parse(t, "# A\n\nbefore\n\n![](chart.png)\n\nafter\n"), []byte("Deck"), 0)
+	before, image, after := strings.Index(marp, "before"), strings.Index(marp, "(chart.png)"), strings.Index(marp, "after")
+	if before < 0 || image < 0 || after < 0 || !(before < image && image < after) {
+		t.Errorf("content is out of order:\n%s", marp)
+	}
+}
+
+func TestReadInputFetchesURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/talk.md":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, "# Remote\n\nbody\n")
+		case "/page":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html></html>")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	content, err := readInput(server.URL + "/talk.md")
+	if err != nil || string(content) != "# Remote\n\nbody\n" {
+		t.Errorf("got %q, %v", content, err)
+	}
+	if _, err := readInput(server.URL + "/missing.md"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("non-200 response: got %v", err)
+	}
+	if _, err := readInput(server.URL + "/page"); err == nil || !strings.Contains(err.Error(), "not markdown") {
+		t.Errorf("HTML response: got %v", err)
+	}
+}
+
+func TestBlankLineRunsAreCollapsed(t *testing.T) {
+	got := collapseBlankLineRuns("a\n\n\n\n\nb\n\nc\n```\nx\n\n\n\ny\n```\n")
+	if want := "a\n\nb\n\nc\n```\nx\n\n\n\ny\n```\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	md := "# A\n\n<div>x</div>\n\n\n\n\n<div>y</div>\n\n\n\n\n# B\n\n\n\n\nbody\n"
+	if marp := md2s([]byte(md), []byte("Deck"), 0, true).Marp; strings.Contains(marp, "\n\n\n\n") {
+		t.Errorf("output has a run of blank lines:\n%q", marp)
+	}
+}
+
+func TestReferenceLinkIsResolved(t *testing.T) {
+	slides := parse(t, "# A\n\nsee [the docs][ref]\n\n[ref]: https://example.com/docs\n")
+	if !strings.Contains(slides[0].Content, "[the docs](https://example.com/docs)") {
+		t.Errorf("reference link lost its URL: %q", slides[0].Content)
+	}
+}
+
+func TestPacingStaysUnderRPM(t *testing.T) {
+	pace := newPacing(15, 1000000)
+	if pace.batchSize >= 15 || pace.batchSize < 1 {
+		t.Errorf("batchSize = %d, want below the limit of 15", pace.batchSize)
+	}
+	if pace.delay < time.Minute {
+		t.Errorf("delay = %v, want at least a minute", pace.delay)
+	}
+	if pace := newPacing(1, 1); pace.batchSize != 1 || pace.batchTokens != 1 {
+		t.Errorf("tiny limits give %+v, want at least one request per batch", pace)
+	}
+}
+
+func TestCountSlidesMatchesHeadings(t *testing.T) {
+	stub := stubGemini(t, replyWith("- summarized"))
+	md := []byte("# A\n\na\n\n## B\n\nb\n\n### C\n\nc\n\n##### not a slide\n")
+	count, err := CountSlides(md, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("got %d slides, want 3", count)
+	}
+	// 分け方の設定も数に反映する
+	fixed := []*Slide{{Content: "fixed"}}
+	if count, err := CountSlides(md, Options{Section: "b", Intro: fixed, Outro: fixed}); err != nil || count != 4 {
+		t.Errorf("with a section and fixed slides: got %d, %v; want 4", count, err)
+	}
+	if sectionName != "" {
+		t.Errorf("counting changed -section to %q", sectionName)
+	}
+	if _, err := CountSlides(md, Options{Extensions: "unknown"}); err == nil {
+		t.Error("an unknown extension was accepted")
+	}
+	if n := len(stub.calls()); n != 0 {
+		t.Errorf("counting sent %d requests to Gemini", n)
+	}
+}
+
+func TestImageTitleIsKept(t *testing.T) {
+	marp := convertToMarp(parse(t, "# A\n\n![a](x.png \"caption\")\n\ninline ![b](y.png \"tip\") icon\n"), []byte("Deck"), 0)
+	for _, want := range []string{`(x.png "caption")`, `![b](y.png "tip")`} {
+		if !strings.Contains(marp, want) {
+			t.Errorf("missing %s:\n%s", want, marp)
+		}
+	}
+}
+
+func TestExtraFrontMatterIsMerged(t *testing.T) {
+	extra := frontMatterFlag{}
+	if err := extra.Set("backgroundColor: black"); err != nil {
+		t.Fatal(err)
+	}
+	if err := extra.Set("marp: false"); err == nil {
+		t.Error("the marp key was accepted")
+	}
+	setGlobal(t, &extraFrontMatter, extra)
+	marp := convertToMarp(parse(t, "# A\n\nbody\n"), []byte("Deck"), 0)
+	frontMatter, _, _ := strings.Cut(strings.TrimPrefix(marp, "---\n"), "\n---\n")
+	if !strings.Contains(frontMatter+"\n", "\nbackgroundColor: black\n") || !strings.Contains(frontMatter, "marp: true") {
+		t.Errorf("front matter was not merged:\n%s", frontMatter)
+	}
+}
+
+func TestResponseTextJoinsEveryPart(t *testing.T) {
+	resp := &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{Content: &genai.Content{Parts: []genai.Part{genai.Text("- first\n"), genai.Text("- second")}}}},
+	}
+	if text, ok := responseText(resp); !ok || text != "- first\n- second\n" {
+		t.Errorf("got %q, %v, want both parts", text, ok)
+	}
+}
+
+func TestNilContentMarksSlideFailed(t *testing.T) {
+	t.Setenv("GEMINI_API_KEY", "test-key")
+	setGlobal(t, &generateContent, func(ctx context.Context, model *genai.GenerativeModel, prompt string) (*genai.GenerateContentResponse, error) {
+		return &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{FinishReason: genai.FinishReasonSafety}}}, nil
+	})
+	slides, err := analyzeContentWithGemini(parse(t, "# A\n\nbody\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slides[0].Failed || !strings.Contains(slides[0].Content, "body") {
+		t.Errorf("slide with an empty response: %+v", slides[0])
+	}
+}
+
+func TestNoClobberKeepsExistingOutput(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "talk.md"), "# A\n\nbody\n")
+	writeFile(t, filepath.Join(dir, "talk_marp.md"), "keep me")
+	_, stderr, code := runMain(t, dir, nil, "-no-clobber", "-title", "Deck", "talk.md")
+	if code != 1 || !strings.Contains(stderr, "already exists") {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	if out, err := os.ReadFile(filepath.Join(dir, "talk_marp.md")); err != nil || string(out) != "keep me" {
+		t.Errorf("existing output was changed: %q, %v", out, err)
+	}
+	if _, stderr, code := runMain(t, dir, summarizedEnv, "-title", "Deck", "talk.md"); code != 0 {
+		t.Errorf("overwriting by default failed with %d:\n%s", code, stderr)
+	}
+}
+
+func TestClassAnnotationIsEmitted(t *testing.T) {
+	marp := convertToMarp(parse(t, "# A\n\n<!-- _class: invert -->\n\nbody\n\n# B\n\nplain\n"), []byte("Deck"), 0)
+	if !strings.Contains(marp, "<!-- _class: invert -->\n# A") {
+		t.Errorf("annotated slide has no class directive:\n%s", marp)
+	}
+	if strings.Count(marp, "_class: invert") != 1 {
+		t.Errorf("class leaked to another slide:\n%s", marp)
+	}
+}
+
+func TestTitlePromptIsBounded(t *testing.T) {
+	stub := stubGemini(t, replyWith("Huge Deck"))
+	huge := []byte("# 概要\n\n" + strings.Repeat("English と日本語が混ざった長い文章です。", 5000))
+	if title := string(generateTitle(huge)); strings.TrimSpace(title) != "Huge Deck" {
+		t.Errorf("got title %q", title)
+	}
+	calls := stub.calls()
+	if len(calls) != 1 {
+		t.Fatalf("got %d requests, want 1", len(calls))
+	}
+	if n := utf8.RuneCountInString(calls[0]); n > maxTitleSourceLength+200 {
+		t.Errorf("title prompt has %d characters, over the bound", n)
+	}
+	if !utf8.ValidString(calls[0]) {
+		t.Error("title prompt is not valid UTF-8")
+	}
+}
+
+func TestSizeDirectiveIsEmitted(t *testing.T) {
+	setGlobal(t, &slideSize, "4:3")
+	marp := convertToMarp(parse(t, "# A\n\nbody\n"), []byte("Deck"), 0)
+	if !strings.Contains(marp, "\nsize: 4:3\n") {
+		t.Errorf("size directive is missing:\n%s", marp)
+	}
+	_, stderr, code := runMain(t, t.TempDir(), nil, "-size", "3:2", "missing.md")
+	if code != 1 || !strings.Contains(stderr, "unsupported size") {
+		t.Errorf("unsupported size: exit code %d\n%s", code, stderr)
+	}
+}
+
+func TestCacheResumesOnlyMissingSlides(t *testing.T) {
+	setGlobal(t, &batchDelay, 0)
+	setGlobal(t, &requestsPerMinute, 3)
+	setGlobal(t, &cacheDir, t.TempDir())
+	md := "# A\n\nalpha\n\n# B\n\nbravo\n\n# C\n\ncharlie\n\n# D\n\ndelta\n"
+	if batches := splitBatches(parse(t, md), newPacing(requestsPerMinute, tokensPerMinute)); len(batches) != 2 {
+		t.Fatalf("got %d batches, want 2", len(batches))
+	}
+
+	// 1回目は2つ目のバッチで失敗する
+	stubGemini(t, func(prompt string) (string, error) {
+		if strings.Contains(prompt, "charlie") || strings.Contains(prompt, "delta") {
+			return "", fmt.Errorf("connection reset")
+		}
+		return "- done", nil
+	})
+	slides, err := analyzeContentWithGemini(parse(t, md))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slides[0].Failed || slides[1].Failed || !slides[2].Failed || !slides[3].Failed {
+		t.Fatalf("first run did not fail on the second batch")
+	}
+
+	// 2回目は失敗したスライドだけ送る
+	stub := stubGemini(t, replyWith("- resumed"))
+	slides, err = analyzeContentWithGemini(parse(t, md))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := stub.calls()
+	if len(calls) != 2 {
+		t.Errorf("got %d requests on resume, want 2", len(calls))
+	}
+	for _, prompt := range calls {
+		if strings.Contains(prompt, "alpha") || strings.Contains(prompt, "bravo") {
+			t.Errorf("a cached slide was sent again: %q", prompt)
+		}
+	}
+	for _, slide := range slides {
+		if slide.Failed {
+			t.Errorf("slide %s is still failed", slide.Title)
+		}
+	}
+}
+
+func TestFrontMatterTagsArePlaced(t *testing.T) {
+	md := "---\ntitle: Talk\ntags:\n  - name: go\n  - name: marp\n---\n# A\n\nbody\n"
+	setGlobal(t, &tagPlacement, "footer")
+	marp := convertToMarp(parse(t, md), []byte("Deck"), 0)
+	frontMatter, _, _ := strings.Cut(marp, "\n---\n# Deck")
+	if !strings.Contains(frontMatter, "footer: ") || !strings.Contains(frontMatter, "go") || !strings.Contains(frontMatter, "marp") {
+		t.Errorf("tags are not in the footer:\n%s", marp)
+	}
+	setGlobal(t, &tagPlacement, "title")
+	marp = convertToMarp(parse(t, md), []byte("Deck"), 0)
+	titleSlide, _, _ := strings.Cut(marp[strings.Index(marp, "# Deck"):], "\n---\n")
+	if !strings.Contains(titleSlide, "go") || !strings.Contains(titleSlide, "marp") || strings.Contains(marp, "footer:") {
+		t.Errorf("tags are not on the title slide:\n%s", marp)
+	}
+}
+
+func TestInputWithoutSlidesIsRejected(t *testing.T) {
+	for _, md := range []string{"", " \n\t\n", "---\ntitle: Only front matter\n---\n", "<!-- _class: lead -->\n"} {
+		if slides, err := parseMarkdown([]byte(md)); err == nil {
+			t.Errorf("%q: got %d slides, want an error", md, len(slides))
+		}
+	}
+}
+
+func TestSafetySettingsAreSetOnModel(t *testing.T) {
+	settings := safetyFlag{}
+	if err := settings.Set("dangerous=none"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Set("violence=none"); err == nil {
+		t.Error("an unknown category was accepted")
+	}
+	setGlobal(t, &safetySettings, settings)
+	t.Setenv("GEMINI_API_KEY", "test-key")
+	var mu sync.Mutex
+	var seen [][]*genai.SafetySetting
+	setGlobal(t, &generateContent, func(ctx context.Context, model *genai.GenerativeModel, prompt string) (*genai.GenerateContentResponse, error) {
+		mu.Lock()
+		seen = append(seen, model.SafetySettings)
+		mu.Unlock()
+		return textResponse("- summarized"), nil
+	})
+	if _, err := analyzeContentWithGemini(parse(t, "# A\n\nbody\n")); err != nil {
+		t.Fatal(err)
+	}
+	generateTitle([]byte("# A\n\nbody\n"))
+	if len(seen) != 2 {
+		t.Fatalf("got %d requests, want 2", len(seen))
+	}
+	for _, got := range seen {
+		if len(got) != 1 || got[0].Category != genai.HarmCategoryDangerousContent || got[0].Threshold != genai.HarmBlockNone {
+			t.Errorf("model has safety settings %v, want dangerous=none", got)
+		}
+	}
+}
+
+// 決まった断片を順に返すストリーミングの応答
+type fakeStream struct {
+	chunks []string
+	err    error // 断片を返し終えた後のエラー（nil なら iterator.Done）
+}
+
+func (s *fakeStream) Next() (*genai.GenerateContentResponse, error) {
+	if len(s.chunks) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, iterator.Done
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return textResponse(chunk), nil
+}
+
+func TestStreamChunksAreConcatenatedInOrder(t *testing.T) {
+	setGlobal(t, &useStream, true)
+	t.Setenv("GEMINI_API_KEY", "test-key")
+	setGlobal(t, &generateContentStream, func(ctx context.Context, model *genai.GenerativeModel, prompt string) contentIterator {
+		return &fakeStream{chunks: []string{"- fir", "st\n- sec", "ond"}}
+	})
+	slides, err := analyzeContentWithGemini(parse(t, "# A\n\nbody\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slides[0].Failed || !strings.Contains(slides[0].Content, "- first\n- second") {
+		t.Errorf("chunks were not joined in order: %q", slides[0].Content)
+	}
+
+	setGlobal(t, &generateContentStream, func(ctx context.Context, model *genai.GenerativeModel, prompt string) contentIterator {
+		return &fakeStream{chunks: []string{"- partial"}, err: fmt.Errorf("connection reset")}
+	})
+	if _, err := generateText(context.Background(), nil, "prompt"); err == nil || !strings.Contains(err.Error(), "stream interrupted") {
+		t.Errorf("interrupted stream: got %v", err)
+	}
+}
+
+func TestQuietLeavesStdoutEmpty(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "talk.md"), "# A\n\nbody\n")
+	stdout, stderr, code := runMain(t, dir, summarizedEnv, "-quiet", "-title", "Deck", "talk.md")
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, stderr)
+	}
+	if stdout != "" {
+		t.Errorf("quiet mode printed:\n%s", stdout)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "talk_marp.md")); err != nil {
+		t.Errorf("output was not written: %v", err)
+	}
+}
+
+func TestTitleIsTrimmedAndEscaped(t *testing.T) {
+	stubGemini(t, func(prompt string) (string, error) {
+		if strings.Contains(prompt, "タイトルを1つ作って") {
+			return "Go <generics> & you\n", nil
+		}
+		return "- summarized", nil
+	})
+	marp := md2s([]byte("# A\n\nbody\n"), nil, 0, false).Marp
+	if !strings.Contains(marp, "\n# Go &lt;generics&gt; &amp; you\n<style scoped>") {
+		t.Errorf("title is not trimmed and escaped:\n%s", marp)
+	}
+}
+
+func TestFinalizersAreAppliedInOrder(t *testing.T) {
+	setGlobal(t, &finalizers, nil)
+	AddFinalizer(func(marp string) string { return marp + "<!-- first -->\n" })
+	AddFinalizer(func(marp string) string { return marp + "<!-- second -->\n" })
+	marp := md2s([]byte("# A\n\nbody\n"), []byte("Deck"), 0, true).Marp
+	if !strings.HasSuffix(marp, "<!-- first -->\n<!-- second -->\n") {
+		t.Errorf("finalizers were not applied in order:\n%s", marp)
+	}
+}
+
+func TestBackgroundModeChangesDirective(t *testing.T) {
+	setGlobal(t, &backgroundMode, "bg cover")
+	marp := convertToMarp(parse(t, "# A\n\n![](wide.png)\n\n![bg left](side.png)\n"), []byte("Deck"), 0)
+	if !strings.Contains(marp, "![bg cover](wide.png)") {
+		t.Errorf("background mode was not used:\n%s", marp)
+	}
+	if !strings.Contains(marp, "![bg left](side.png)") {
+		t.Errorf("per-image hint was not kept:\n%s", marp)
+	}
+}
+
+func TestDuplicateTitlesAreDisambiguated(t *testing.T) {
+	md := "# Intro\n\na\n\n## Example\n\nb\n\n# Usage\n\nc\n\n## Example\n\nd\n"
+	setGlobal(t, &dedupeTitles, "counter")
+	marp := convertToMarp(parse(t, md), []byte("Deck"), 0)
+	if !strings.Contains(marp, "# Example\n") || !strings.Contains(marp, "# Example (2)\n") {
+		t.Errorf("counter was not appended:\n%s", marp)
+	}
+	setGlobal(t, &dedupeTitles, "parent")
+	marp = convertToMarp(parse(t, md), []byte("Deck"), 0)
+	if !strings.Contains(marp, "# Example - Usage\n") {
+		t.Errorf("parent was not used to disambiguate:\n%s", marp)
+	}
+}
+
+func TestSubscriptMarkersSurvive(t *testing.T) {
+	setGlobal(t, &markdownExtensions, "gfm,subscript,superscript")
+	content := parse(t, "# A\n\nH~2~O and x^2^\n")[0].Content
+	if !strings.Contains(content, "~2~") || !strings.Contains(content, "^2^") {
+		t.Errorf("markers were lost: %q", content)
+	}
+}
+
+func TestIntermediateDumpHasRawContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "parsed.md")
+	setGlobal(t, &dumpIntermediate, path)
+	stubGemini(t, replyWith("- summarized"))
+	md2s([]byte("# A\n\nunsummarized\n\n```go\nfmt.Println()\n```\n"), []byte("Deck"), 0, false)
+	dump, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"## A", "unsummarized", "fmt.Println()"} {
+		if !strings.Contains(string(dump), want) {
+			t.Errorf("dump is missing %q:\n%s", want, dump)
+		}
+	}
+	if strings.Contains(string(dump), "- summarized") {
+		t.Errorf("dump contains the summary:\n%s", dump)
+	}
+}
+
+func TestOuterFenceIsStrippedButInnerCodeKept(t *testing.T) {
+	got := stripOuterFence("```markdown\n- uses\n\n```go\nx := 1\n```\n```")
+	if want := "- uses\n\n```go\nx := 1\n```"; strings.TrimSpace(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := stripOuterFence("- plain\n"); got != "- plain\n" {
+		t.Errorf("unfenced summary changed: %q", got)
+	}
+}
+
+func TestKeepNestingRestoresIndentation(t *testing.T) {
+	setGlobal(t, &keepNesting, true)
+	stub := stubGemini(t, func(prompt string) (string, error) {
+		if strings.Contains(prompt, "Second") {
+			return "- Two", nil
+		}
+		return "- One\n- A\n- B", nil
+	})
+	slides, err := analyzeContentWithGemini(parse(t, "# A\n\n- First\n  - Alpha\n  - Beta\n- Second\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(stub.calls()); n != 2 {
+		t.Errorf("got %d requests, want one per top-level item", n)
+	}
+	for _, prompt := range stub.calls() {
+		if !strings.Contains(prompt, "入れ子（インデント）はそのまま") {
+			t.Errorf("prompt does not ask to keep the nesting:\n%s", prompt)
+		}
+	}
+	if !strings.Contains(slides[0].Content, "- One\n  - A\n  - B\n") || !strings.Contains(slides[0].Content, "- Two") {
+		t.Errorf("nesting was not restored: %q", slides[0].Content)
+	}
+}
+
+func TestZennMessageBecomesQuote(t *testing.T) {
+	setGlobal(t, &containerDialect, "zenn")
+	content := parse(t, "# A\n\n:::message\nnotice\n:::\n\n:::message alert\ndanger\n:::\n")[0].Content
+	for _, want := range []string{"> **ℹ メッセージ**", "> **⚠ 注意**", "notice", "danger"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("missing %q in %q", want, content)
+		}
+	}
+	if strings.Contains(content, ":::") {
+		t.Errorf("container markers were kept: %q", content)
+	}
+}
+
+func TestBatchesDoNotMixSlideContent(t *testing.T) {
+	setGlobal(t, &batchDelay, 0)
+	setGlobal(t, &requestsPerMinute, 3)
+	numbered := regexp.MustCompile(`slide\s+(\d+)\.`)
+	stubGemini(t, func(prompt string) (string, error) {
+		return "- summary" + numbered.FindStringSubmatch(prompt)[1], nil
+	})
+	slides, err := analyzeContentWithGemini(parse(t, numberedSlides(7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batches := splitBatches(slides, newPacing(requestsPerMinute, tokensPerMinute)); len(batches) != 4 {
+		t.Fatalf("got %d batches, want 4", len(batches))
+	}
+	for i, slide := range slides {
+		if want := fmt.Sprintf("- summary%d", i+1); strings.TrimSpace(slide.Content) != want {
+			t.Errorf("slide %d: got %q, want %q", i+1, slide.Content, want)
+		}
+	}
+}
+
+func TestImageCaptionsAreRendered(t *testing.T) {
+	setGlobal(t, &imageCaptions, true)
+	marp := convertToMarp(parse(t, "# A\n\n![Architecture](arch.png)\n\n![chart](chart.png)\n\n*Figure 2*\n"), []byte("Deck"), 0)
+	if !strings.Contains(marp, "(arch.png)\n\n<style scoped>section{justify-content:flex-end;text-align:center}</style>\n\nArchitecture") {
+		t.Errorf("alt text caption is missing:\n%s", marp)
+	}
+	if !strings.Contains(marp, "\n\nFigure 2") || strings.Contains(marp, "*Figure 2*") {
+		t.Errorf("italic caption was not used:\n%s", marp)
+	}
+}
+
+func TestBulletsArePaddedOrTrimmedToN(t *testing.T) {
+	if got := fitBullets("- a\n- b\n- c\n- d\n- e", 3); countBullets(got) != 3 {
+		t.Errorf("trimming gave:\n%s", got)
+	}
+	if got := fitBullets("- First point. Second point.\n- Third point. Fourth point.", 3); countBullets(got) != 3 {
+		t.Errorf("padding gave:\n%s", got)
+	}
+	setGlobal(t, &bulletsPerSlide, 3)
+	stub := stubGemini(t, replyWith("- a\n- b\n- c\n- d"))
+	slides, err := analyzeContentWithGemini(parse(t, "# A\n\nbody\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stub.calls()[0], "ちょうど3個") {
+		t.Errorf("prompt does not ask for 3 bullets:\n%s", stub.calls()[0])
+	}
+	if n := countBullets(slides[0].Content); n != 3 {
+		t.Errorf("got %d bullets, want 3:\n%s", n, slides[0].Content)
+	}
+}
+
+func TestPDFModeSetsDirectivesAndStripsScript(t *testing.T) {
+	setGlobal(t, &pdfMode, true)
+	marp := convertToMarp(parse(t, "# A\n\n<script>alert(1)</script>\n\nkept text\n"), []byte("Deck"), 0)
+	frontMatter, _, _ := strings.Cut(marp, "\n---\n# Deck")
+	if !strings.Contains(frontMatter, "\npaginate: true") || !strings.Contains(frontMatter, "\nsize: 16:9") {
+		t.Errorf("PDF directives are missing:\n%s", frontMatter)
+	}
+	if strings.Contains(marp, "<script") || strings.Contains(marp, "alert(1)") {
+		t.Errorf("script tag was not stripped:\n%s", marp)
+	}
+	if !strings.Contains(marp, "kept") {
+		t.Errorf("text was lost:\n%s", marp)
+	}
+}
+
+func TestOutputModeIsApplied(t *testing.T) {
+	setGlobal(t, &outputMode, 0600)
+	path := filepath.Join(t.TempDir(), "deck_marp.md")
+	// 既存のファイルも指定のパーミッションにする
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeOutput(path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("mode = %o, want 600", mode)
+	}
+}
+
+func TestMarpToMarkdownRoundTrip(t *testing.T) {
+	marp := convertToMarp(parse(t, "# First\n\nalpha\n\n![](chart.png)\n\n# Second\n\n```go\nx := 1\n```\n"), []byte("Deck"), 0)
+	md, err := MarpToMarkdown(marp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, unwanted := range []string{"marp: true", "<style scoped>", "\n---\n", "![bg"} {
+		if strings.Contains(md, unwanted) {
+			t.Errorf("%q is left in:\n%s", unwanted, md)
+		}
+	}
+	for _, want := range []string{"# Deck", "# First", "alpha", "![](chart.png)", "# Second", "```go\nx := 1\n```"} {
+		if !strings.Contains(md, want) {
+			t.Errorf("%q is missing from:\n%s", want, md)
+		}
+	}
+	if strings.Count(md, "# First") != 1 {
+		t.Errorf("repeated heading was not merged:\n%s", md)
+	}
+	// 戻したマークダウンはもう一度同じスライドに分けられる
+	if slides := parse(t, md); len(slides) != 3 {
+		t.Errorf("got %d slides from the round trip, want 3", len(slides))
+	}
+}
+
+func TestSubtitleIsOnTitleSlide(t *testing.T) {
+	setGlobal(t, &subtitle, "Go Conference 2026")
+	setGlobal(t, &author, "Sam")
+	marp := convertToMarp(parse(t, "# A\n\nbody\n"), []byte("Deck"), 0)
+	titleSlide, _, _ := strings.Cut(marp[strings.Index(marp, "# Deck"):], "\n---\n")
+	if !strings.Contains(titleSlide, "Go Conference 2026") || !strings.Contains(titleSlide, "Sam") {
+		t.Errorf("subtitle is not on the title slide:\n%s", titleSlide)
+	}
+}
+
+func TestEntitiesAreNotEscapedTwice(t *testing.T) {
+	marp := convertToMarp(parse(t, "# Q&amp;A\n\nR&amp;D and &lt;tags&gt;\n"), []byte("Tom &amp; Jerry"), 0)
+	if strings.Contains(marp, "&amp;amp;") || strings.Contains(marp, "&amp;lt;") {
+		t.Errorf("entity was escaped twice:\n%s", marp)
+	}
+	for _, want := range []string{"# Tom &amp; Jerry\n", "&amp;D", "&lt;tags&gt;"} {
+		if !strings.Contains(marp, want) {
+			t.Errorf("%q is missing from:\n%s", want, marp)
+		}
+	}
+}
+
+func TestMissingAPIKeyFallsBackToOutline(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "talk.md"), "# Setup\n\nInstall everything first.\n")
+	_, stderr, code := runMain(t, dir, nil, "talk.md")
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, stderr)
+	}
+	if !strings.Contains(stderr, "GEMINI_API_KEY is not set") {
+		t.Errorf("no warning on stderr:\n%s", stderr)
+	}
+	marp, err := os.ReadFile(filepath.Join(dir, "talk_marp.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(marp), "# talk\n") || !strings.Contains(string(marp), "# Setup") || !strings.Contains(string(marp), "everything") {
+		t.Errorf("outline output is missing content:\n%s", marp)
+	}
+	if _, _, code := runMain(t, dir, nil, "-require-ai", "talk.md"); code != 1 {
+		t.Errorf("-require-ai without a key: exit code %d, want 1", code)
+	}
+}
+
+func TestLeadingProseBecomesLeadSlide(t *testing.T) {
+	slides := parse(t, "This article explains everything.\n\n# First\n\nbody\n")
+	if len(slides) != 2 || slides[0].Class != "lead" || !strings.Contains(slides[0].Content, "explains") {
+		t.Fatalf("leading prose is not a lead slide: %+v", slides[0])
+	}
+	marp := convertToMarp(slides, []byte("Deck"), 0)
+	if lead, first := strings.Index(marp, "explains"), strings.Index(marp, "# First"); lead < strings.Index(marp, "# Deck") || lead > first {
+		t.Errorf("lead slide is not between the title and the first heading:\n%s", marp)
+	}
+	if !strings.Contains(marp, "<!-- _class: lead -->") {
+		t.Errorf("lead class is missing:\n%s", marp)
+	}
+}
+
+func TestBatchesStayUnderTokenBudget(t *testing.T) {
+	long := strings.Repeat("many words in a long slide ", 300)
+	md := "# A\n\nshort\n\n# B\n\n" + long + "\n\n# C\n\nshort\n\n# D\n\nshort\n\n# E\n\n" + long + "\n"
+	slides := parse(t, md)
+	budget := heuristicTokens(buildSummaryPrompt(slides[1])) + 2*heuristicTokens(buildSummaryPrompt(slides[0]))
+	pace := pacing{batchSize: 100, batchTokens: budget}
+	batches := splitBatches(slides, pace)
+	if len(batches) < 2 {
+		t.Fatalf("got %d batches, want the long slides split apart", len(batches))
+	}
+	next := 0
+	for _, batch := range batches {
+		if batch.start != next {
+			t.Errorf("batches are not contiguous: %v", batches)
+		}
+		next = batch.end
+		tokens := 0
+		for _, slide := range slides[batch.start:batch.end] {
+			tokens += heuristicTokens(buildSummaryPrompt(slide))
+		}
+		if tokens > budget && batch.end-batch.start > 1 {
+			t.Errorf("batch %v has %d tokens, over the budget of %d", batch, tokens, budget)
+		}
+	}
+	if next != len(slides) {
+		t.Errorf("batches do not cover every slide: %v", batches)
+	}
+}
+
+func TestTimingHintFromWordCount(t *testing.T) {
+	setGlobal(t, &timingWPM, 120)
+	marp := convertToMarp(parse(t, "# A\n\n"+strings.TrimSpace(strings.Repeat("word ", 60))+"\n"), []byte("Deck"), 0)
+	if !strings.Contains(marp, "<!-- ~30s -->") {
+		t.Errorf("60 words at 120 wpm should be 30s:\n%s", marp)
+	}
+	if got := speakingSeconds("日本語の文章", 120); got != 2 {
+		t.Errorf("Japanese text: got %ds, want 2s", got)
+	}
+}
+
+func TestGeneratedTitleQuotesAreStripped(t *testing.T) {
+	for reply, want := range map[string]string{
+		"「Go 入門」\n":       "Go 入門",
+		`"Intro to Go"`:   "Intro to Go",
+		"『「二重」』":          "二重",
+		"「A」と「B」":         "「A」と「B」",
+		"'Go' and 'Rust'": "'Go' and 'Rust'",
+	} {
+		stubGemini(t, replyWith(reply))
+		if got := strings.TrimSpace(string(generateTitle([]byte("# A\n\nbody\n")))); got != want {
+			t.Errorf("reply %q: got %q, want %q", reply, got, want)
+		}
+	}
+}
+
+func TestSourceLineCommentHasHeadingLine(t *testing.T) {
+	setGlobal(t, &sourceLines, true)
+	md := "---\ntitle: Talk\n---\n# First\n\nbody\n\n\n## Second\n\nmore\n"
+	marp := convertToMarp(parse(t, md), []byte("Deck"), 0)
+	if !strings.Contains(marp, "# First\n\n<!-- source: line 4 -->") || !strings.Contains(marp, "# Second\n\n<!-- source: line 9 -->") {
+		t.Errorf("source line comments are wrong:\n%s", marp)
+	}
+}
+
+func TestSectionSelectsSubtree(t *testing.T) {
+	setGlobal(t, &sectionName, "usage")
+	slides := parse(t, "# Intro\n\nhello\n\n# Usage\n\nrun\n\n## Flags\n\nflags\n\n# FAQ\n\nquestions\n")
+	var titles []string
+	for _, slide := range slides {
+		titles = append(titles, slide.Title)
+	}
+	if strings.Join(titles, ",") != "Usage,Flags" {
+		t.Errorf("got slides %q, want Usage and Flags", titles)
+	}
+	setGlobal(t, &sectionName, "Missing")
+	if _, err := parseMarkdown([]byte("# Intro\n\nhello\n")); err == nil || !strings.Contains(err.Error(), "section not found") {
+		t.Errorf("missing section: got %v", err)
+	}
+}
+
+func TestRequestBudgetStopsAfterMaxRequests(t *testing.T) {
+	setGlobal(t, &maxRequests, 3)
+	setGlobal(t, &batchDelay, 0)
+	requestCount.Store(0)
+	t.Cleanup(func() { requestCount.Store(0) })
+	stub := stubGemini(t, replyWith("- summarized"))
+	slides, err := analyzeContentWithGemini(parse(t, numberedSlides(5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(stub.calls()); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+	summarized := 0
+	for _, slide := range slides {
+		if strings.Contains(slide.Content, "- summarized") {
+			summarized++
+		} else if !strings.Contains(slide.Content, "body of") {
+			t.Errorf("unsummarized slide lost its content: %q", slide.Content)
+		}
+	}
+	if summarized != 3 {
+		t.Errorf("%d slides were summarized, want 3", summarized)
+	}
+}
+
+func TestStrikethroughMarkersSurvive(t *testing.T) {
+	content := parse(t, "# A\n\nthe ~~deprecated~~ flag\n")[0].Content
+	if !strings.Contains(content, "~~deprecated~~") {
+		t.Errorf("strikethrough markers were lost: %q", content)
+	}
+}
+
+func TestOrderDirectiveMovesSlide(t *testing.T) {
+	titles := func(md string) string {
+		var got []string
+		for _, slide := range orderSlides(parse(t, md)) {
+			got = append(got, slide.Title)
+		}
+		return strings.Join(got, ",")
+	}
+	if got := titles("# A\n\na\n\n# B\n\nb\n\n# C\n\n<!-- order: 1 -->\n\nc\n"); got != "C,A,B" {
+		t.Errorf("order: 1 gave %s, want C,A,B", got)
+	}
+	if got := titles("# A\n\n<!-- order: 3 -->\n\na\n\n# B\n\nb\n\n# C\n\nc\n\n# D\n\nd\n"); got != "B,C,A,D" {
+		t.Errorf("order: 3 gave %s, want B,C,A,D", got)
+	}
+}
+
+func TestTOCFollowsSlideOrder(t *testing.T) {
+	setGlobal(t, &tocMode, "links")
+	md := "# Alpha\n\na\n\n## Beta\n\n![](b.png)\n\n# Gamma\n\n<!-- order: 1 -->\n\nc\n"
+	marp := convertToMarp(parse(t, md), []byte("Deck"), 0)
+	toc := "- [Gamma](#3)\n- [Alpha](#4)\n  - [Beta](#5)\n"
+	if !strings.Contains(marp, toc) {
+		t.Errorf("TOC does not follow the output order:\n%s", marp)
+	}
+	if gamma, alpha := strings.Index(marp, "# Gamma"), strings.Index(marp, "# Alpha"); gamma > alpha {
+		t.Errorf("slides are not in the TOC order:\n%s", marp)
+	}
+}
+
+func TestInlineElementsStayOnTheirLine(t *testing.T) {
+	setGlobal(t, &markdownExtensions, "gfm,subscript")
+	for md, want := range map[string]string{
+		"## H\nLead sentence.\n":                                "Lead sentence.\n",
+		"# A\n\nH~2~O is water\n":                               "H~2~O is water\n",
+		"# A\n\nsee [the docs](https://x.dev) for more\n":       "see [the docs](https://x.dev) for more\n",
+		"# A\n\nends with [a link](u)\nnext line\n":             "ends with [a link](u)\nnext line\n",
+		"# A\n\n- first item\n- second *emph* item\n":           "- first item\n- second emph item\n",
+		"# A\n\nrun `make test` before ![ok](ok.png) pushing\n": "run `make test` before ![ok](ok.png) pushing\n",
+	} {
+		if got := parse(t, md)[0].Content; got != want {
+			t.Errorf("%q: got %q, want %q", md, got, want)
+		}
+	}
+}
+
+func TestLinkedImageIsKeptAsOneUnit(t *testing.T) {
+	content := parse(t, "# A\n\nsee [![build](badge.svg)](https://ci.example.com) here\n")[0].Content
+	if want := "see [![build](badge.svg)](https://ci.example.com) here\n"; content != want {
+		t.Errorf("got %q, want %q", content, want)
+	}
+	marp := convertToMarp(parse(t, "# A\n\n[![diagram](arch.png)](https://example.com/arch)\n"), []byte("Deck"), 0)
+	if !strings.Contains(marp, "[![diagram](arch.png)](https://example.com/arch)") {
+		t.Errorf("linked image was not kept:\n%s", marp)
+	}
+}
+
+func TestCleanHeadingsStripsNumberAndAttributes(t *testing.T) {
+	setGlobal(t, &cleanHeadings, true)
+	slides := parse(t, "## 1. Title {#id}\n\nbody\n\n## 2.3 Next {.wide}\n\nmore\n\n## 2024 Roadmap\n\nplan\n")
+	for i, want := range []string{"Title", "Next", "2024 Roadmap"} {
+		if slides[i].Title != want {
+			t.Errorf("slide %d: got %q, want %q", i+1, slides[i].Title, want)
+		}
+	}
+}
+
+func TestFormatNormalizesListMarkers(t *testing.T) {
+	got := formatMarkdown("* one  \n+   two\n  *\tnested\n1)  first\n* * *\n```\n*  code  \n```")
+	if want := "- one\n- two\n  - nested\n1) first\n* * *\n```\n*  code  \n```"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTruncationKeepsValidUTF8(t *testing.T) {
+	const text = "日本語のタイトルを途中で切る"
+	got, truncated := truncateRunes(text, 5)
+	if !truncated || got != "日本語のタ" || !utf8.ValidString(got) {
+		t.Errorf("truncateRunes = %q, %v", got, truncated)
+	}
+	if got, truncated := truncateRunes(text, 100); truncated || got != text {
+		t.Errorf("short string was changed: %q, %v", got, truncated)
+	}
+	if got := titleSource([]byte("一行目の文章\n二行目の文章"), 9); got != "一行目の文章" || !utf8.ValidString(got) {
+		t.Errorf("titleSource = %q", got)
+	}
+	for _, piece := range splitByTokens(strings.Repeat("あ", 5000), 100) {
+		if !utf8.ValidString(piece) {
+			t.Fatalf("split produced invalid UTF-8: %q", piece)
+		}
+	}
+}
+
+func TestPreflightCatchesAuthFailure(t *testing.T) {
+	t.Setenv("GEMINI_API_KEY", "test-key")
+	setGlobal(t, &countTokens, func(ctx context.Context, model *genai.GenerativeModel, text string) (*genai.CountTokensResponse, error) {
+		return nil, fmt.Errorf("API key not valid")
+	})
+	if err := preflightGemini(context.Background()); err == nil || !strings.Contains(err.Error(), "pre-flight") {
+		t.Errorf("got %v, want a pre-flight error", err)
+	}
+	if got := countTokensWith(context.Background(), nil)("four words of text"); got != heuristicTokens("four words of text") {
+		t.Errorf("failed count gave %d, want the estimate", got)
+	}
+	setGlobal(t, &countTokens, func(ctx context.Context, model *genai.GenerativeModel, text string) (*genai.CountTokensResponse, error) {
+		return &genai.CountTokensResponse{TotalTokens: 42}, nil
+	})
+	if err := preflightGemini(context.Background()); err != nil {
+		t.Errorf("pre-flight failed: %v", err)
+	}
+	if got := countTokensWith(context.Background(), nil)("text"); got != 42 {
+		t.Errorf("got %d tokens, want 42", got)
+	}
+
+	// 失敗したらスライドを処理する前に終了する
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "talk.md"), "# A\n\nbody\n")
+	_, stderr, code := runMain(t, dir, []string{"GEMINI_API_KEY=test-key"}, "talk.md")
+	if code != 1 || !strings.Contains(stderr, "pre-flight") || strings.Contains(stderr, "unexpected Gemini request") {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "talk_marp.md")); err == nil {
+		t.Error("output was written although the pre-flight check failed")
+	}
+}
+
+func TestCombineAddsDividerBetweenFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "one.md"), "# Alpha\n\nfirst file\n")
+	writeFile(t, filepath.Join(dir, "two.md"), "# Beta\n\nsecond file\n")
+	_, stderr, code := runMain(t, dir, nil, "-combine", "deck.md", "-dividers", "-title", "Deck", "one.md", "two.md")
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, stderr)
+	}
+	marp, err := os.ReadFile(filepath.Join(dir, "deck_marp.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := []string{"# one.md", "# Alpha", "first file", "# two.md", "# Beta", "second file"}
+	last := -1
+	for _, want := range order {
+		i := strings.Index(string(marp), want)
+		if i < 0 || i < last {
+			t.Errorf("%q is missing or out of order:\n%s", want, marp)
+			break
+		}
+		last = i
+	}
+	if !strings.Contains(string(marp), "<!-- _class: lead -->\n# two.md") {
+		t.Errorf("divider is not a lead slide:\n%s", marp)
+	}
+}
+
+func TestFailingSlideDoesNotBlockBatch(t *testing.T) {
+	setGlobal(t, &slideTimeout, 200*time.Millisecond)
+	stubGemini(t, func(prompt string) (string, error) {
+		if strings.Contains(prompt, "broken") {
+			return "", fmt.Errorf("googleapi: Error 503: UNAVAILABLE")
+		}
+		return "- summarized", nil
+	})
+	start := time.Now()
+	slides, err := analyzeContentWithGemini(parse(t, "# A\n\nfine\n\n# B\n\nbroken\n\n# C\n\nfine\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("batch took %v, want it bounded by the slide timeout", elapsed)
+	}
+	if slides[0].Failed || !slides[1].Failed || slides[2].Failed {
+		t.Errorf("failed flags = %v %v %v, want only B failed", slides[0].Failed, slides[1].Failed, slides[2].Failed)
+	}
+	if !strings.Contains(slides[0].Content, "- summarized") || !strings.Contains(slides[1].Content, "broken") {
+		t.Errorf("unexpected contents: %q, %q", slides[0].Content, slides[1].Content)
+	}
+}
+
+func TestThemeNameIsUsed(t *testing.T) {
+	setGlobal(t, &themeName, "corporate")
+	style, err := loadThemeStyle("https://example.com/corporate.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &themeStyle, style)
+	marp := convertToMarp(parse(t, "# A\n\nbody\n"), []byte("Deck"), 0)
+	frontMatter, _, _ := strings.Cut(marp, "\n---\n# Deck")
+	if !strings.Contains(frontMatter+"\n", "\ntheme: corporate\n") || strings.Contains(frontMatter, "theme: default") {
+		t.Errorf("theme directive does not use the name:\n%s", frontMatter)
+	}
+	if !strings.Contains(frontMatter, "style: |\n  @import url(\"https://example.com/corporate.css\");") {
+		t.Errorf("theme CSS is not registered:\n%s", frontMatter)
+	}
+	_, stderr, code := runMain(t, t.TempDir(), nil, "-theme-name", "bad name", "missing.md")
+	if code != 1 || !strings.Contains(stderr, "bad name") {
+		t.Errorf("invalid theme name: exit code %d\n%s", code, stderr)
+	}
+}
+
+func TestBOMIsStripped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bom.md")
+	writeFile(t, path, "\xEF\xBB\xBF# First\n\nbody\n")
+	content, err := readInput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slides := parse(t, string(content))
+	if len(slides) != 1 || slides[0].Title != "First" || slides[0].Class == "lead" {
+		t.Errorf("heading after the BOM was not parsed: %+v", slides[0])
+	}
+}
+
+func TestCheckReportsEachProblemOnce(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "ok.md"), "# A\n\nbody\n")
+	writeFile(t, filepath.Join(dir, "broken.md"), "# A\n\n```sh\nmake\n\n# B\n\nrest\n")
+	stdout, stderr, code := runMain(t, dir, []string{"GEMINI_API_KEY=test-key"}, "-check", "ok.md")
+	if code != 0 || stdout != "ok.md: 1 slides\n" {
+		t.Errorf("valid file: exit code %d, stdout %q\n%s", code, stdout, stderr)
+	}
+	if strings.Contains(stderr, "unexpected Gemini request") || strings.Contains(stderr, "Document") {
+		t.Errorf("check called Gemini or printed debug output:\n%s", stderr)
+	}
+	_, stderr, code = runMain(t, dir, nil, "-check", "broken.md")
+	if code != 1 {
+		t.Errorf("broken file: exit code %d, want 1", code)
+	}
+	if n := strings.Count(stderr, "unterminated"); n != 1 || !strings.Contains(stderr, "[ERROR] broken.md: code fence may be unterminated") {
+		t.Errorf("problem was printed %d times:\n%s", n, stderr)
+	}
+}
+
+func TestTrailingSpacesFollowHardBreakPolicy(t *testing.T) {
+	md := "# A\n\nline one  \nline two \n\n- item  \n"
+	if got := parse(t, md)[0].Content; got != "line one\nline two\n- item\n" {
+		t.Errorf("default: got %q, want trailing spaces removed", got)
+	}
+	setGlobal(t, &keepHardBreaks, true)
+	if got := parse(t, md)[0].Content; got != "line one  \nline two\n- item\n" {
+		t.Errorf("-hard-breaks: got %q, want only the hard break kept", got)
+	}
+}
+
+func TestHeuristicTokensIsInRange(t *testing.T) {
+	for _, tc := range []struct {
+		text     string
+		min, max int
+	}{
+		{"", 0, 0},
+		{strings.Repeat("The quick brown fox jumps over the lazy dog. ", 10), 90, 130},
+		{strings.Repeat("日本語の文章を要約します。", 10), 60, 130},
+		{strings.Repeat("Go 言語で Marp のスライドを作る。", 10), 100, 220},
+	} {
+		if got := heuristicTokens(tc.text); got < tc.min || got > tc.max {
+			head, _ := truncateRunes(tc.text, 20)
+			t.Errorf("%q: got %d tokens, want %d-%d", head, got, tc.min, tc.max)
+		}
+	}
+}
+
+func TestSourceNotesKeepOriginalText(t *testing.T) {
+	setGlobal(t, &sourceNotes, true)
+	stubGemini(t, replyWith("- short point"))
+	slides, err := analyzeContentWithGemini(parse(t, "# A\n\nThe original long explanation.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	marp := convertToMarp(slides, []byte("Deck"), 0)
+	visible, notes, found := strings.Cut(marp[strings.Index(marp, "# A"):], "<!--")
+	if !found {
+		t.Fatalf("no notes comment:\n%s", marp)
+	}
+	if !strings.Contains(visible, "- short point") || strings.Contains(visible, "original long explanation") {
+		t.Errorf("visible part is wrong:\n%s", visible)
+	}
+	if !strings.Contains(notes, "The original long explanation.") {
+		t.Errorf("original text is not in the notes:\n%s", notes)
+	}
+}
+
+func TestTitleGenerationRetriesTransientError(t *testing.T) {
+	setGlobal(t, &rateLimitBackoff, time.Millisecond)
+	failures := 0
+	stub := stubGemini(t, func(prompt string) (string, error) {
+		if failures == 0 {
+			failures++
+			return "", fmt.Errorf("googleapi: Error 503: UNAVAILABLE")
+		}
+		return "Retried Deck", nil
+	})
+	if title := strings.TrimSpace(string(generateTitle([]byte("# A\n\nbody\n")))); title != "Retried Deck" {
+		t.Errorf("got title %q, want the title from the retry", title)
+	}
+	if n := len(stub.calls()); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+}
+
+func TestLevelClassMapsHeadingLevels(t *testing.T) {
+	classes := levelClassFlag{}
+	if err := classes.Set("1=lead"); err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &levelClasses, classes)
+	md := "# Part\n\nintro\n\n## Detail\n\nbody\n\n# Next\n\n<!-- _class: invert -->\n\nmore\n"
+	marp := convertToMarp(parse(t, md), []byte("Deck"), 0)
+	for _, want := range []string{"<!-- _class: lead -->\n# Part", "# Detail", "<!-- _class: invert -->\n# Next"} {
+		if !strings.Contains(marp, want) {
+			t.Errorf("%q is missing:\n%s", want, marp)
+		}
+	}
+	if strings.Contains(marp, "<!-- _class: lead -->\n# Detail") {
+		t.Errorf("level 2 slide got the level 1 class:\n%s", marp)
+	}
+	// reveal.js でも見出しのレベルのクラスを付ける
+	reveal := RevealRenderer{}.Render(parse(t, md), []byte("Deck"), 0)
+	for _, want := range []string{"<!-- .slide: class=\"lead\" -->\n\n## Part", "<!-- .slide: class=\"invert\" -->\n\n## Next"} {
+		if !strings.Contains(reveal, want) {
+			t.Errorf("%q is missing:\n%s", want, reveal)
+		}
+	}
+	if strings.Count(reveal, ".slide: class=") != 2 {
+		t.Errorf("level 2 slide got a class:\n%s", reveal)
+	}
+}
+
+func TestInlineHTMLStaysOnItsLine(t *testing.T) {
+	slides := parse(t, "# A\n\npress <kbd>Enter</kbd> now\n\nH<sub>2</sub>O\n\n<div>block</div>\n")
+	if want := "press <kbd>Enter</kbd> now\nH<sub>2</sub>O\n\n<div>block</div>\n\n"; slides[0].Content != want {
+		t.Errorf("got %q, want %q", slides[0].Content, want)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// 下付き文字（H~2~O）と上付き文字（x^2^）のノード
+var KindSubscript = ast.NewNodeKind("Subscript")
+var KindSuperscript = ast.NewNodeKind("Superscript")
+
+type scriptNode struct {
+	ast.BaseInline
+	kind   ast.NodeKind
+	marker byte
+}
+
+func (n *scriptNode) Kind() ast.NodeKind {
+	return n.kind
+}
+
+func (n *scriptNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// 記号で囲まれた部分を下付き・上付き文字として読むパーサー
+// 囲む中身は空白を含まない1語だけにし、~~ の取り消し線とは区別する
+type scriptParser struct {
+	kind   ast.NodeKind
+	marker byte
+}
+
+func (p *scriptParser) Trigger() []byte {
+	return []byte{p.marker}
+}
+
+func (p *scriptParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	if block.PrecendingCharacter() == rune(p.marker) {
+		return nil
+	}
+	line, segment := block.PeekLine()
+	if len(line) < 3 || line[1] == p.marker {
+		return nil
+	}
+	end := 1
+	for end < len(line) && line[end] != p.marker {
+		if util.IsSpace(line[end]) {
+			return nil
+		}
+		end++
+	}
+	if end == len(line) || end == 1 {
+		return nil
+	}
+	node := &scriptNode{kind: p.kind, marker: p.marker}
+	node.AppendChild(node, ast.NewTextSegment(text.NewSegment(segment.Start+1, segment.Start+end)))
+	block.Advance(end + 1)
+	return node
+}
+
+type scriptExtension struct {
+	kind   ast.NodeKind
+	marker byte
+}
+
+func (e *scriptExtension) Extend(m goldmark.Markdown) {
+	// 取り消し線（優先度 500）より先に判定する（値が小さいほど先）
+	m.Parser().AddOptions(parser.WithInlineParsers(
+		util.Prioritized(&scriptParser{kind: e.kind, marker: e.marker}, 400),
+	))
+}
+
+var Subscript = &scriptExtension{kind: KindSubscript, marker: '~'}
+var Superscript = &scriptExtension{kind: KindSuperscript, marker: '^'}
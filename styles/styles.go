@@ -8,3 +8,21 @@ var ThemeList = []string{
 	"\ntheme: uncover\nclass: lead\n",
 	"\ntheme: uncover\nclass: lead invert\n",
 }
+
+// reveal.js 出力時のテーマ（ThemeList と同じ番号で明暗を合わせる）
+var RevealThemeList = []string{
+	"theme: white\n",
+	"theme: black\n",
+	"theme: simple\n",
+	"theme: night\n",
+	"theme: serif\n",
+	"theme: moon\n",
+}
+
+// 要約スタイルごとのプロンプト
+var SummaryStyleList = map[string]string{
+	"bullets":  "コンテンツを箇条書きプレゼン調に要約。",
+	"prose":    "コンテンツを段落の文章で要約。",
+	"concise":  "コンテンツを1行で簡潔に要約。",
+	"takeaway": "コンテンツの重要なポイントを3つまでに絞って要約。",
+}